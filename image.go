@@ -0,0 +1,306 @@
+package Netpbm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+)
+
+// ReadJPEG reads a JPEG file and returns it as a P6 PPM image. The EXIF
+// orientation tag, if present, is applied so rotated photos import upright.
+func ReadJPEG(filename string) (*PPM, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %v", err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding JPEG: %v", err)
+	}
+	ppm := PPMFromImage(img)
+	ppm.ApplyOrientation(exifOrientation(content))
+	return ppm, nil
+}
+
+// PPMFromImage converts any image.Image to an 8-bit P6 PPM image.
+func PPMFromImage(img image.Image) *PPM {
+	bounds := img.Bounds()
+	data, pix := newPixelGrid(bounds.Dx(), bounds.Dy())
+	ppm := &PPM{
+		data:        data,
+		pix:         pix,
+		width:       bounds.Dx(),
+		height:      bounds.Dy(),
+		magicNumber: "P6",
+		max:         255,
+	}
+	for y := 0; y < ppm.height; y++ {
+		for x := 0; x < ppm.width; x++ {
+			ppm.data[y][x] = pixelAt(img, bounds.Min.X+x, bounds.Min.Y+y)
+		}
+	}
+	return ppm
+}
+
+// PGMFromImage converts any image.Image to an 8-bit P5 PGM image using
+// Rec. 601 luminance weighting.
+func PGMFromImage(img image.Image) *PGM {
+	bounds := img.Bounds()
+	pgm := &PGM{
+		data:        make([][]uint16, bounds.Dy()),
+		width:       bounds.Dx(),
+		height:      bounds.Dy(),
+		magicNumber: "P5",
+		max:         255,
+	}
+	for y := 0; y < pgm.height; y++ {
+		pgm.data[y] = make([]uint16, pgm.width)
+		for x := 0; x < pgm.width; x++ {
+			pgm.data[y][x] = rgbToGray(pixelAt(img, bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return pgm
+}
+
+// PBMFromImage converts any image.Image to a P4 PBM image. A pixel is set
+// (black) where its 8-bit luminance is below threshold.
+func PBMFromImage(img image.Image, threshold uint8) *PBM {
+	bounds := img.Bounds()
+	pbm := NewPBM(bounds.Dx(), bounds.Dy())
+	pbm.magicNumber = "P4"
+	for y := 0; y < pbm.height; y++ {
+		for x := 0; x < pbm.width; x++ {
+			pbm.data[y][x] = rgbToGray(pixelAt(img, bounds.Min.X+x, bounds.Min.Y+y)) < uint16(threshold)
+		}
+	}
+	return pbm
+}
+
+// pixelAt returns the color of img at (x, y) as an 8-bit Pixel.
+func pixelAt(img image.Image, x, y int) Pixel {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return Pixel{R: uint16(r >> 8), G: uint16(g >> 8), B: uint16(b >> 8)}
+}
+
+// exifOrientation returns the EXIF orientation tag (0x0112) of a JPEG file,
+// or 1 (upright) when the file has no readable EXIF orientation.
+func exifOrientation(content []byte) int {
+	if len(content) < 4 || content[0] != 0xFF || content[1] != 0xD8 {
+		return 1
+	}
+	offset := 2
+	for offset+4 <= len(content) {
+		if content[offset] != 0xFF {
+			return 1
+		}
+		marker := content[offset+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image: no more metadata segments.
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(content[offset+2:]))
+		if length < 2 || offset+2+length > len(content) {
+			return 1
+		}
+		segment := content[offset+4 : offset+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		offset += 2 + length
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation tag from the first IFD of a TIFF block.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// NewPBMFromImageAlpha builds a coverage mask from img: a pixel is set where
+// its 8-bit alpha exceeds alphaThreshold, regardless of its color.
+func NewPBMFromImageAlpha(img image.Image, alphaThreshold uint8) *PBM {
+	bounds := img.Bounds()
+	pbm := NewPBM(bounds.Dx(), bounds.Dy())
+	for y := 0; y < pbm.height; y++ {
+		for x := 0; x < pbm.width; x++ {
+			_, _, _, a := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			pbm.data[y][x] = uint8(a>>8) > alphaThreshold
+		}
+	}
+	return pbm
+}
+
+// scaleTo8 rescales a sample from [0, max] to [0, 255].
+func scaleTo8(value, max uint16) uint8 {
+	if max == 0 {
+		return 0
+	}
+	if value >= max {
+		return 255
+	}
+	return uint8((uint32(value)*255 + uint32(max)/2) / uint32(max))
+}
+
+// ppmImage adapts a PPM image to image.Image.
+type ppmImage struct {
+	ppm *PPM
+}
+
+func (img ppmImage) ColorModel() color.Model { return color.RGBAModel }
+
+func (img ppmImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, img.ppm.width, img.ppm.height)
+}
+
+func (img ppmImage) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(img.Bounds())) {
+		return color.RGBA{}
+	}
+	pixel := img.ppm.data[y][x]
+	max := img.ppm.max
+	return color.RGBA{R: scaleTo8(pixel.R, max), G: scaleTo8(pixel.G, max), B: scaleTo8(pixel.B, max), A: 255}
+}
+
+// ToImage returns an image.Image view of the PPM image with color.RGBA pixels.
+// Samples are scaled from the image's max value to 0-255.
+func (ppm *PPM) ToImage() image.Image {
+	return ppmImage{ppm}
+}
+
+// AsRGBA copies the PPM image into a new opaque *image.RGBA, scaling samples
+// from the image's max value to 0-255.
+func (ppm *PPM) AsRGBA() *image.RGBA {
+	rgba := image.NewRGBA(image.Rect(0, 0, ppm.width, ppm.height))
+	for y := 0; y < ppm.height; y++ {
+		row := rgba.Pix[y*rgba.Stride:]
+		for x := 0; x < ppm.width; x++ {
+			pixel := ppm.data[y][x]
+			row[x*4] = scaleTo8(pixel.R, ppm.max)
+			row[x*4+1] = scaleTo8(pixel.G, ppm.max)
+			row[x*4+2] = scaleTo8(pixel.B, ppm.max)
+			row[x*4+3] = 255
+		}
+	}
+	return rgba
+}
+
+// SaveIndexedPNG writes the image as a paletted PNG of at most maxColors
+// (1-256) colors. The palette is chosen by median cut and every pixel is
+// mapped to its nearest palette color; samples are scaled to 8 bits.
+func (ppm *PPM) SaveIndexedPNG(filename string, maxColors int) error {
+	if maxColors < 1 || maxColors > 256 {
+		return fmt.Errorf("invalid palette size %d: must be between 1 and 256", maxColors)
+	}
+	palette := ppm.medianCut(maxColors)
+	colors := make(color.Palette, len(palette))
+	for i, p := range palette {
+		colors[i] = color.RGBA{R: scaleTo8(p.R, ppm.max), G: scaleTo8(p.G, ppm.max), B: scaleTo8(p.B, ppm.max), A: 255}
+	}
+	img := image.NewPaletted(image.Rect(0, 0, ppm.width, ppm.height), colors)
+	cache := make(map[Pixel]uint8)
+	for y := 0; y < ppm.height; y++ {
+		for x := 0; x < ppm.width; x++ {
+			pixel := ppm.data[y][x]
+			index, ok := cache[pixel]
+			if !ok {
+				index = uint8(nearestIndex(palette, pixel))
+				cache[pixel] = index
+			}
+			img.Pix[y*img.Stride+x] = index
+		}
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer file.Close()
+	err = png.Encode(file, img)
+	if err != nil {
+		return fmt.Errorf("error encoding PNG: %v", err)
+	}
+	return nil
+}
+
+// pgmImage adapts a PGM image to image.Image.
+type pgmImage struct {
+	pgm *PGM
+}
+
+func (img pgmImage) ColorModel() color.Model { return color.GrayModel }
+
+func (img pgmImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, img.pgm.width, img.pgm.height)
+}
+
+func (img pgmImage) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(img.Bounds())) {
+		return color.Gray{}
+	}
+	return color.Gray{Y: scaleTo8(img.pgm.data[y][x], img.pgm.max)}
+}
+
+// ToImage returns an image.Image view of the PGM image with color.Gray pixels.
+// Samples are scaled from the image's max value to 0-255.
+func (pgm *PGM) ToImage() image.Image {
+	return pgmImage{pgm}
+}
+
+// pbmImage adapts a PBM image to image.Image.
+type pbmImage struct {
+	pbm *PBM
+}
+
+func (img pbmImage) ColorModel() color.Model { return color.GrayModel }
+
+func (img pbmImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, img.pbm.width, img.pbm.height)
+}
+
+func (img pbmImage) At(x, y int) color.Color {
+	if img.pbm.At(x, y) {
+		return color.Black
+	}
+	return color.White
+}
+
+// ToImage returns an image.Image view of the PBM image, with set pixels
+// black and unset pixels white.
+func (pbm *PBM) ToImage() image.Image {
+	return pbmImage{pbm}
+}
@@ -0,0 +1,267 @@
+package Netpbm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// exifSegment returns a JPEG APP1 segment holding a big-endian TIFF block
+// with a single orientation entry.
+func exifSegment(orientation uint16) []byte {
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // header, first IFD at offset 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, byte(orientation >> 8), byte(orientation), 0, 0,
+		0, 0, 0, 0, // no next IFD
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	length := len(payload) + 2
+	return append([]byte{0xFF, 0xE1, byte(length >> 8), byte(length)}, payload...)
+}
+
+func TestReadJPEGAppliesOrientation(t *testing.T) {
+	// Stored sideways: red on the left, blue on the right. Orientation 6
+	// means the camera was turned, so upright the red half is on top.
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			if x < 8 {
+				img.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	content := encoded.Bytes()
+	content = append(append(append([]byte{}, content[:2]...), exifSegment(6)...), content[2:]...)
+	filename := filepath.Join(t.TempDir(), "photo.jpg")
+	if err := os.WriteFile(filename, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ppm, err := ReadJPEG(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := ppm.Size(); w != 8 || h != 16 {
+		t.Fatalf("size = %dx%d, want 8x16", w, h)
+	}
+	if top := ppm.At(4, 3); top.R < 200 || top.B > 50 {
+		t.Errorf("top pixel = %v, want red", top)
+	}
+	if bottom := ppm.At(4, 12); bottom.B < 200 || bottom.R > 50 {
+		t.Errorf("bottom pixel = %v, want blue", bottom)
+	}
+}
+
+func TestNewPBMFromImageAlpha(t *testing.T) {
+	// Opaque left third, half-transparent middle third, clear right third,
+	// with colors that would threshold the opposite way by luminance.
+	img := image.NewNRGBA(image.Rect(0, 0, 6, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 6; x++ {
+			switch {
+			case x < 2:
+				img.Set(x, y, color.NRGBA{255, 255, 255, 255})
+			case x < 4:
+				img.Set(x, y, color.NRGBA{0, 0, 0, 128})
+			default:
+				img.Set(x, y, color.NRGBA{0, 0, 0, 0})
+			}
+		}
+	}
+	for _, tc := range []struct {
+		threshold uint8
+		edge      int // first unset column
+	}{{0, 4}, {127, 4}, {128, 2}, {255, 0}} {
+		pbm := NewPBMFromImageAlpha(img, tc.threshold)
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 6; x++ {
+				if got, want := pbm.At(x, y), x < tc.edge; got != want {
+					t.Errorf("threshold %d: pixel (%d,%d) = %v, want %v", tc.threshold, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestToImagePNGRoundTrip(t *testing.T) {
+	ppm := NewPPM(5, 4, 255)
+	pgm := NewPGM(5, 4, 255)
+	pbm := NewPBM(5, 4)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 5; x++ {
+			ppm.Set(x, y, Pixel{uint16(x * 60), uint16(y * 80), uint16(x*y*10 + 3)})
+			pgm.Set(x, y, uint16(x*50+y))
+			pbm.Set(x, y, (x+y)%2 == 0)
+		}
+	}
+
+	for name, img := range map[string]image.Image{"PPM": ppm.ToImage(), "PGM": pgm.ToImage(), "PBM": pbm.ToImage()} {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Bounds() != image.Rect(0, 0, 5, 4) {
+			t.Fatalf("%s: decoded bounds = %v, want 5x4", name, decoded.Bounds())
+		}
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 5; x++ {
+				r1, g1, b1, a1 := img.At(x, y).RGBA()
+				r2, g2, b2, a2 := decoded.At(x, y).RGBA()
+				if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+					t.Errorf("%s: pixel (%d,%d) = %v after PNG, want %v", name, x, y, decoded.At(x, y), img.At(x, y))
+				}
+			}
+		}
+	}
+
+	if got := ppm.ToImage().At(2, 3); got != (color.RGBA{120, 240, 63, 255}) {
+		t.Errorf("PPM At(2, 3) = %v, want {120 240 63 255}", got)
+	}
+	if got := pgm.ToImage().At(3, 1); got != (color.Gray{151}) {
+		t.Errorf("PGM At(3, 1) = %v, want {151}", got)
+	}
+	if got := pbm.ToImage().At(1, 1); got != color.Black {
+		t.Errorf("PBM At(1, 1) = %v, want black", got)
+	}
+}
+
+// embeddedPNG is a 3x2 RGB PNG: red, green, blue over black, gray 128, white.
+const embeddedPNG = "iVBORw0KGgoAAAANSUhEUgAAAAMAAAACCAIAAAASFvFNAAAAFklEQVR42mP4z8DAAMMMDQ0N////BwA6YQd7Ap/f9AAAAABJRU5ErkJggg=="
+
+func TestFromImage(t *testing.T) {
+	content, err := base64.StdEncoding.DecodeString(embeddedPNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ppm := PPMFromImage(img)
+	if w, h := ppm.Size(); w != 3 || h != 2 {
+		t.Fatalf("PPM size = %dx%d, want 3x2", w, h)
+	}
+	for _, tc := range []struct {
+		x, y int
+		want Pixel
+	}{{0, 0, Pixel{255, 0, 0}}, {2, 0, Pixel{0, 0, 255}}, {1, 1, Pixel{128, 128, 128}}} {
+		if got := ppm.At(tc.x, tc.y); got != tc.want {
+			t.Errorf("PPM pixel (%d,%d) = %v, want %v", tc.x, tc.y, got, tc.want)
+		}
+	}
+
+	pgm := PGMFromImage(img)
+	if w, h := pgm.Size(); w != 3 || h != 2 {
+		t.Fatalf("PGM size = %dx%d, want 3x2", w, h)
+	}
+	for _, tc := range []struct {
+		x, y int
+		want uint16
+	}{{0, 0, 76}, {1, 0, 149}, {2, 0, 29}, {0, 1, 0}, {2, 1, 255}} {
+		if got := pgm.At(tc.x, tc.y); got != tc.want {
+			t.Errorf("PGM pixel (%d,%d) = %d, want %d", tc.x, tc.y, got, tc.want)
+		}
+	}
+
+	pbm := PBMFromImage(img, 128)
+	want := newPBMFrom(
+		"101",
+		"110",
+	)
+	if diff, err := pbm.Diff(want); err != nil || diff != 0 {
+		t.Errorf("PBM = %v, want %v", pbm.data, want.data)
+	}
+}
+
+func TestAsRGBA(t *testing.T) {
+	ppm := NewPPM(2, 1, 1000)
+	ppm.Set(0, 0, Pixel{1000, 500, 0})
+	ppm.Set(1, 0, Pixel{2, 998, 250})
+	rgba := ppm.AsRGBA()
+	if got, want := rgba.RGBAAt(0, 0), (color.RGBA{255, 128, 0, 255}); got != want {
+		t.Errorf("RGBAAt(0, 0) = %v, want %v", got, want)
+	}
+	if got, want := rgba.RGBAAt(1, 0), (color.RGBA{1, 254, 64, 255}); got != want {
+		t.Errorf("RGBAAt(1, 0) = %v, want %v", got, want)
+	}
+	if rgba.Bounds() != image.Rect(0, 0, 2, 1) {
+		t.Errorf("bounds = %v, want 2x1", rgba.Bounds())
+	}
+}
+
+func TestSaveIndexedPNG(t *testing.T) {
+	colors := []Pixel{{255, 0, 0}, {0, 255, 0}, {0, 0, 255}, {250, 250, 10}}
+	ppm := NewPPM(8, 8, 255)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			ppm.Set(x, y, colors[(x/4)+2*(y/4)])
+		}
+	}
+	filename := filepath.Join(t.TempDir(), "indexed.png")
+	if err := ppm.SaveIndexedPNG(filename, 4); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paletted, ok := img.(*image.Paletted)
+	if !ok {
+		t.Fatalf("decoded %T, want *image.Paletted", img)
+	}
+	if len(paletted.Palette) > 4 {
+		t.Errorf("palette has %d colors, want at most 4", len(paletted.Palette))
+	}
+	if diff, err := PPMFromImage(img).Diff(ppm); err != nil || diff != 0 {
+		t.Errorf("decoded image differs in %d pixels (%v)", diff, err)
+	}
+	if err := ppm.SaveIndexedPNG(filename, 0); err == nil {
+		t.Error("SaveIndexedPNG with 0 colors succeeded")
+	}
+}
+
+func TestSaveIndexedPNGDeterministic(t *testing.T) {
+	ppm := NewPPM(3, 1, 255)
+	ppm.data[0] = []Pixel{{0, 0, 0}, {0, 200, 0}, {0, 200, 255}}
+	dir := t.TempDir()
+	var first []byte
+	// The palette once depended on map order, so a single save could pass by luck.
+	for i := 0; i < 20; i++ {
+		filename := filepath.Join(dir, "indexed.png")
+		if err := ppm.SaveIndexedPNG(filename, 2); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = data
+		} else if !bytes.Equal(data, first) {
+			t.Fatalf("save %d differs from the first save", i)
+		}
+	}
+}
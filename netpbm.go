@@ -0,0 +1,638 @@
+package Netpbm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GeneratorComment is the comment emitted when SaveOptions.WriteGeneratorComment is set.
+const GeneratorComment = "Generated by Netpbm"
+
+// SaveOptions controls the optional parts of the header written by SaveWithOptions.
+type SaveOptions struct {
+	// WriteGeneratorComment emits a "# Generated by Netpbm" line after the magic number.
+	WriteGeneratorComment bool
+	// AlignColumns zero-pads ASCII samples (P2, P3) to the digit width of the
+	// max value so the data lines up as a grid.
+	AlignColumns bool
+}
+
+// sampleFormat returns the fmt verb used to write one ASCII sample.
+func sampleFormat(max uint16, opts SaveOptions) string {
+	if !opts.AlignColumns {
+		return "%d"
+	}
+	return fmt.Sprintf("%%0%dd", len(strconv.Itoa(int(max))))
+}
+
+// writeComments writes the header comment lines that follow the magic number:
+// the generator comment if requested, the free-form comments, then one
+// "# key: value" line per metadata entry in key order.
+func writeComments(w io.Writer, comments []string, metadata map[string]string, opts SaveOptions) error {
+	var lines []string
+	if opts.WriteGeneratorComment {
+		lines = append(lines, GeneratorComment)
+	}
+	for _, comment := range comments {
+		if opts.WriteGeneratorComment && comment == GeneratorComment {
+			continue
+		}
+		lines = append(lines, comment)
+	}
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, key+": "+metadata[key])
+	}
+	for _, comment := range lines {
+		for _, line := range strings.Split(comment, "\n") {
+			_, err := fmt.Fprintf(w, "# %s\n", line)
+			if err != nil {
+				return fmt.Errorf("error writing comment: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// splitMetadata separates header comments of the form "key: value" into a
+// metadata map, returning the remaining free-form comments. Keys are a single
+// word (see checkMetadata); later duplicates win.
+func splitMetadata(comments []string) ([]string, map[string]string) {
+	var rest []string
+	var metadata map[string]string
+	for _, comment := range comments {
+		key, value, found := strings.Cut(comment, ":")
+		value = strings.TrimSpace(value)
+		if !found || checkMetadata(key, value) != nil {
+			rest = append(rest, comment)
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[key] = value
+	}
+	return rest, metadata
+}
+
+// checkMetadata reports whether key and value survive a round trip through a
+// "# key: value" comment: the key must be a non-empty run of letters, digits,
+// '-', '_' or '.', and the value must fit on one line.
+func checkMetadata(key, value string) error {
+	if key == "" {
+		return fmt.Errorf("empty metadata key")
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("invalid metadata key %q", key)
+		}
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("metadata value for %q must be a single line", key)
+	}
+	return nil
+}
+
+// setMetadata validates and stores a metadata entry, allocating the map on
+// first use.
+func setMetadata(metadata *map[string]string, key, value string) error {
+	value = strings.TrimSpace(value)
+	err := checkMetadata(key, value)
+	if err != nil {
+		return err
+	}
+	if *metadata == nil {
+		*metadata = make(map[string]string)
+	}
+	(*metadata)[key] = value
+	return nil
+}
+
+// copyMetadata returns a copy of metadata, or nil if it is empty.
+func copyMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return copied
+}
+
+// resolutionKey is the metadata key holding the physical resolution.
+const resolutionKey = "dpi"
+
+// setResolution stores dpiX and dpiY as "dpi" metadata: a single number when
+// they are equal, "XxY" otherwise.
+func setResolution(metadata *map[string]string, dpiX, dpiY float64) error {
+	if !(dpiX > 0) || !(dpiY > 0) || math.IsInf(dpiX, 0) || math.IsInf(dpiY, 0) {
+		return fmt.Errorf("invalid resolution %gx%g dpi", dpiX, dpiY)
+	}
+	value := strconv.FormatFloat(dpiX, 'g', -1, 64)
+	if dpiY != dpiX {
+		value += "x" + strconv.FormatFloat(dpiY, 'g', -1, 64)
+	}
+	return setMetadata(metadata, resolutionKey, value)
+}
+
+// resolution parses the "dpi" metadata, returning zeros when it is missing or
+// malformed.
+func resolution(metadata map[string]string) (float64, float64) {
+	x, y, found := strings.Cut(metadata[resolutionKey], "x")
+	if !found {
+		y = x
+	}
+	dpiX, errX := strconv.ParseFloat(x, 64)
+	dpiY, errY := strconv.ParseFloat(y, 64)
+	if errX != nil || errY != nil || !(dpiX > 0) || !(dpiY > 0) {
+		return 0, 0
+	}
+	return dpiX, dpiY
+}
+
+// physicalSize converts a pixel size to inches at the resolution stored in
+// metadata, returning zeros when no resolution is set.
+func physicalSize(width, height int, metadata map[string]string) (float64, float64) {
+	dpiX, dpiY := resolution(metadata)
+	if dpiX == 0 {
+		return 0, 0
+	}
+	return float64(width) / dpiX, float64(height) / dpiY
+}
+
+// ReadOptions controls optional behaviour of the ReadWithOptions functions.
+type ReadOptions struct {
+	// Stats, when non-nil, receives metrics about the decode.
+	Stats *DecodeStats
+	// AssumeMaxVal255 accepts PGM and PPM files whose max value line is
+	// missing. When the token after the dimensions is not a valid max value,
+	// or the data size only adds up without it, the max value is taken to be
+	// 255 and the token is read as pixel data. The rest of the file is
+	// buffered in memory to decide.
+	AssumeMaxVal255 bool
+}
+
+// DecodeStats reports decoder metrics for profiling ingestion pipelines.
+type DecodeStats struct {
+	BytesRead   int64         // bytes pulled from the underlying file
+	RowsDecoded int           // pixel rows fully decoded
+	Elapsed     time.Duration // time spent opening and decoding
+}
+
+// record fills the stats; it does nothing on a nil receiver.
+func (stats *DecodeStats) record(bytesRead int64, rows int, start time.Time) {
+	if stats == nil {
+		return
+	}
+	*stats = DecodeStats{BytesRead: bytesRead, RowsDecoded: rows, Elapsed: time.Since(start)}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeBuffered runs encode against a buffered writer over w, flushes it, and
+// returns the number of bytes that reached w.
+func writeBuffered(w io.Writer, encode func(writer *bufio.Writer) error) (int64, error) {
+	counter := &countingWriter{writer: w}
+	writer := bufio.NewWriter(counter)
+	err := encode(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	return counter.n, err
+}
+
+// checkCrop reports whether [x, x+w) x [y, y+h) is a non-empty rectangle
+// inside a width x height image.
+func checkCrop(x, y, w, h, width, height int) error {
+	if w <= 0 || h <= 0 {
+		return fmt.Errorf("invalid crop size %dx%d", w, h)
+	}
+	if x < 0 || y < 0 || x+w > width || y+h > height {
+		return fmt.Errorf("crop rectangle (%d,%d)-(%d,%d) is outside the %dx%d image", x, y, x+w, y+h, width, height)
+	}
+	return nil
+}
+
+// rotation returns the size of a width x height image rotated clockwise by
+// angle degrees about its center, grown to contain the rotated bounds, and a
+// function mapping each destination pixel back to its source position.
+// Source positions put pixel centers on integer coordinates, as in
+// SampleBilinear, and may fall outside the source image.
+func rotation(width, height int, angle float64) (int, int, func(x, y int) (float64, float64)) {
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	w, h := float64(width), float64(height)
+	// Round away floating-point noise so exact quarter turns keep their size.
+	newWidth := int(math.Ceil(math.Abs(w*cos) + math.Abs(h*sin) - 1e-9))
+	newHeight := int(math.Ceil(math.Abs(w*sin) + math.Abs(h*cos) - 1e-9))
+	cx, cy := (w-1)/2, (h-1)/2
+	ncx, ncy := float64(newWidth-1)/2, float64(newHeight-1)/2
+	return newWidth, newHeight, func(x, y int) (float64, float64) {
+		dx, dy := float64(x)-ncx, float64(y)-ncy
+		return cx + dx*cos + dy*sin, cy - dx*sin + dy*cos
+	}
+}
+
+// rescaleSample maps value from [0, from] to [0, to], rounding to the nearest
+// integer and clamping to to. A zero from maps everything to 0.
+func rescaleSample(value, from, to uint16) uint16 {
+	if from == 0 {
+		return 0
+	}
+	scaled := math.Round(float64(value) * float64(to) / float64(from))
+	return uint16(math.Min(scaled, float64(to)))
+}
+
+// quarterTurns reports whether angle, in degrees, is an exact multiple of 90
+// and if so how many clockwise quarter turns (0-3) it amounts to.
+func quarterTurns(angle float64) (int, bool) {
+	turns := angle / 90
+	if turns != math.Trunc(turns) || math.IsInf(turns, 0) {
+		return 0, false
+	}
+	return mod(int(math.Mod(turns, 4)), 4), true
+}
+
+// translation returns the mapping used by the Translate methods: for a
+// destination pixel it gives the source pixel shifted by (dx, dy), and false
+// when that pixel is uncovered and should take the fill value. mode is "wrap",
+// which wraps the source around the edges, or "fill".
+func translation(dx, dy, width, height int, mode string) (func(x, y int) (int, int, bool), error) {
+	switch mode {
+	case "wrap":
+		return func(x, y int) (int, int, bool) {
+			return mod(x-dx, width), mod(y-dy, height), true
+		}, nil
+	case "fill":
+		return func(x, y int) (int, int, bool) {
+			sx, sy := x-dx, y-dy
+			return sx, sy, sx >= 0 && sx < width && sy >= 0 && sy < height
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid translate mode %q: must be \"wrap\" or \"fill\"", mode)
+}
+
+// mod returns a modulo n in [0, n).
+func mod(a, n int) int {
+	return ((a % n) + n) % n
+}
+
+// Interpolation selects how resampling operations such as RotateInterpolated
+// compute a pixel that falls between source pixels.
+type Interpolation int
+
+const (
+	// NearestNeighbor copies the closest source pixel. It never invents new
+	// values, so it is the right choice for masks and label images.
+	NearestNeighbor Interpolation = iota
+	// Bilinear blends the four surrounding source pixels.
+	Bilinear
+	// Bicubic fits a Catmull-Rom spline through the surrounding 4x4 pixels,
+	// giving the sharpest result at the highest cost.
+	Bicubic
+)
+
+// interpolate samples a width x height grid at (fx, fy), with pixel centers on
+// integer coordinates. sample is only called with coordinates inside the grid;
+// neighbors beyond the edge repeat the edge pixel. Unknown modes fall back to
+// NearestNeighbor.
+func interpolate(fx, fy float64, width, height int, interp Interpolation, sample func(x, y int) float64) float64 {
+	at := func(x, y int) float64 {
+		return sample(clamp(x, 0, width-1), clamp(y, 0, height-1))
+	}
+	switch interp {
+	case Bilinear:
+		x0, y0 := math.Floor(fx), math.Floor(fy)
+		tx, ty := fx-x0, fy-y0
+		x, y := int(x0), int(y0)
+		top := at(x, y)*(1-tx) + at(x+1, y)*tx
+		bottom := at(x, y+1)*(1-tx) + at(x+1, y+1)*tx
+		return top*(1-ty) + bottom*ty
+	case Bicubic:
+		x0, y0 := math.Floor(fx), math.Floor(fy)
+		var wx, wy [4]float64
+		for i := range wx {
+			wx[i] = cubicWeight(fx - (x0 + float64(i-1)))
+			wy[i] = cubicWeight(fy - (y0 + float64(i-1)))
+		}
+		sum := 0.0
+		for j := range wy {
+			for i := range wx {
+				sum += wx[i] * wy[j] * at(int(x0)+i-1, int(y0)+j-1)
+			}
+		}
+		return sum
+	default:
+		return at(int(math.Round(fx)), int(math.Round(fy)))
+	}
+}
+
+// cubicWeight is the Catmull-Rom kernel (a = -0.5) at distance t.
+func cubicWeight(t float64) float64 {
+	const a = -0.5
+	t = math.Abs(t)
+	switch {
+	case t <= 1:
+		return (a+2)*t*t*t - (a+3)*t*t + 1
+	case t < 2:
+		return a*t*t*t - 5*a*t*t + 8*a*t - 4*a
+	}
+	return 0
+}
+
+// brighten adds delta to value, saturating at 0 and max.
+func brighten(value uint16, delta int, max uint16) uint16 {
+	return uint16(clamp(int(value)+delta, 0, int(max)))
+}
+
+// contrast scales value's distance from the mid-point max/2 by factor,
+// saturating at 0 and max.
+func contrast(value uint16, factor float64, max uint16) uint16 {
+	mid := float64(max) / 2
+	scaled := math.Round(mid + (float64(value)-mid)*factor)
+	return uint16(math.Max(0, math.Min(scaled, float64(max))))
+}
+
+// bytesPerSample returns the size of one binary sample for the given max
+// value: one byte up to 255, two big-endian bytes above.
+func bytesPerSample(max uint16) int {
+	if max > 255 {
+		return 2
+	}
+	return 1
+}
+
+// getSample decodes the i-th binary sample of row.
+func getSample(row []byte, i, size int) uint16 {
+	if size == 2 {
+		return uint16(row[i*2])<<8 | uint16(row[i*2+1])
+	}
+	return uint16(row[i])
+}
+
+// putSample encodes value as the i-th binary sample of row.
+func putSample(row []byte, i, size int, value uint16) {
+	if size == 2 {
+		row[i*2], row[i*2+1] = byte(value>>8), byte(value)
+		return
+	}
+	row[i] = byte(value)
+}
+
+// parallelPackThreshold is the payload size below which rows are packed serially.
+const parallelPackThreshold = 1 << 16
+
+// packRows allocates the binary payload for height rows of rowBytes bytes each
+// and fills it by calling pack for every row. Large payloads are split into
+// contiguous bands packed concurrently; the result is identical either way.
+func packRows(height, rowBytes int, pack func(y int, row []byte)) []byte {
+	payload := make([]byte, height*rowBytes)
+	workers := runtime.GOMAXPROCS(0)
+	if len(payload) < parallelPackThreshold || workers < 2 || height < 2 {
+		for y := 0; y < height; y++ {
+			pack(y, payload[y*rowBytes:(y+1)*rowBytes])
+		}
+		return payload
+	}
+
+	if workers > height {
+		workers = height
+	}
+	band := (height + workers - 1) / workers
+	var wg sync.WaitGroup
+	for start := 0; start < height; start += band {
+		end := start + band
+		if end > height {
+			end = height
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for y := start; y < end; y++ {
+				pack(y, payload[y*rowBytes:(y+1)*rowBytes])
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return payload
+}
+
+// streamFormats maps each magic number to its plain/raw counterpart and the
+// number of samples per pixel.
+var streamFormats = map[string]struct {
+	pair     string
+	channels int
+}{
+	"P1": {"P4", 1}, "P4": {"P1", 1},
+	"P2": {"P5", 1}, "P5": {"P2", 1},
+	"P3": {"P6", 3}, "P6": {"P3", 3},
+}
+
+// ConvertStream reads a Netpbm image from in and writes it to out as
+// targetMagic, one row at a time, so memory use is bounded by a single row
+// regardless of the image size. The target must be the same image type as
+// the source (P1/P4, P2/P5 or P3/P6); header comments are carried over.
+func ConvertStream(in io.Reader, out io.Writer, targetMagic string) error {
+	reader := bufio.NewReader(in)
+	var comments []string
+	magicNumber, err := readHeaderToken(reader, &comments)
+	if err != nil {
+		return fmt.Errorf("error reading magic number: %v", err)
+	}
+	format, ok := streamFormats[magicNumber]
+	if !ok {
+		return fmt.Errorf("invalid magic number: %s", magicNumber)
+	}
+	if targetMagic != magicNumber && targetMagic != format.pair {
+		return fmt.Errorf("cannot convert %s to %s", magicNumber, targetMagic)
+	}
+	width, height, err := readDimensions(reader, &comments)
+	if err != nil {
+		return err
+	}
+	bitmap := magicNumber == "P1" || magicNumber == "P4"
+	max := uint16(1)
+	if !bitmap {
+		max, err = readMaxValue(reader, &comments)
+		if err != nil {
+			return fmt.Errorf("error reading max value: %v", err)
+		}
+	}
+
+	writer := bufio.NewWriter(out)
+	fmt.Fprintf(writer, "%s\n", targetMagic)
+	err = writeComments(writer, comments, nil, SaveOptions{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(writer, "%d %d\n", width, height)
+	if !bitmap {
+		fmt.Fprintf(writer, "%d\n", max)
+	}
+
+	row := make([]uint16, width*format.channels)
+	var raw []byte
+	for y := 0; y < height; y++ {
+		raw, err = readStreamRow(reader, magicNumber, row, max, raw)
+		if err != nil {
+			return fmt.Errorf("error reading row %d: %v", y, err)
+		}
+		raw, err = writeStreamRow(writer, targetMagic, row, max, raw)
+		if err != nil {
+			return fmt.Errorf("error writing row %d: %v", y, err)
+		}
+	}
+	return writer.Flush()
+}
+
+// readStreamRow decodes one row of samples (0 or 1 for bitmaps, with 1 set)
+// into row. buf is scratch space for binary rows and is returned for reuse.
+func readStreamRow(reader *bufio.Reader, magicNumber string, row []uint16, max uint16, buf []byte) ([]byte, error) {
+	switch magicNumber {
+	case "P1":
+		for i := range row {
+			bit, err := readBit(reader)
+			if err != nil {
+				return buf, err
+			}
+			row[i] = bit
+		}
+	case "P2", "P3":
+		for i := range row {
+			token, err := readToken(reader)
+			if err != nil {
+				return buf, err
+			}
+			value, err := strconv.ParseUint(token, 10, 16)
+			if err != nil {
+				return buf, fmt.Errorf("invalid sample %q", token)
+			}
+			row[i] = uint16(value)
+		}
+	case "P4":
+		buf = resize(buf, (len(row)+7)/8)
+		_, err := io.ReadFull(reader, buf)
+		if err != nil {
+			return buf, err
+		}
+		for i := range row {
+			row[i] = uint16(buf[i/8]>>(7-i%8)) & 1
+		}
+	default:
+		size := bytesPerSample(max)
+		buf = resize(buf, len(row)*size)
+		_, err := io.ReadFull(reader, buf)
+		if err != nil {
+			return buf, err
+		}
+		for i := range row {
+			row[i] = getSample(buf, i, size)
+		}
+	}
+	return buf, nil
+}
+
+// readBit reads the next plain PBM pixel, skipping whitespace and comments.
+// Pixels need not be separated, so "0110" holds four of them.
+func readBit(reader *bufio.Reader) (uint16, error) {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case b == '0' || b == '1':
+			return uint16(b - '0'), nil
+		case b == '#':
+			_, err = readComment(reader)
+			if err != nil {
+				return 0, err
+			}
+		case !isSpace(b):
+			return 0, fmt.Errorf("invalid pixel %q", b)
+		}
+	}
+}
+
+// writeStreamRow encodes one row of samples in the layout Save uses for
+// targetMagic. buf is scratch space and is returned for reuse.
+func writeStreamRow(writer *bufio.Writer, targetMagic string, row []uint16, max uint16, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	switch targetMagic {
+	case "P1":
+		for _, bit := range row {
+			buf = append(buf, byte('0'+bit), ' ')
+		}
+		buf = append(buf, '\n')
+	case "P2":
+		for i, value := range row {
+			if i > 0 {
+				buf = append(buf, ' ')
+			}
+			buf = strconv.AppendUint(buf, uint64(value), 10)
+		}
+		buf = append(buf, '\n')
+	case "P3":
+		for _, value := range row {
+			buf = strconv.AppendUint(buf, uint64(value), 10)
+			buf = append(buf, ' ')
+		}
+		buf = append(buf, '\n')
+	case "P4":
+		buf = resize(buf, (len(row)+7)/8)
+		clear(buf)
+		for i, bit := range row {
+			buf[i/8] |= byte(bit&1) << (7 - i%8)
+		}
+	default:
+		size := bytesPerSample(max)
+		buf = resize(buf, len(row)*size)
+		for i, value := range row {
+			putSample(buf, i, size, value)
+		}
+	}
+	_, err := writer.Write(buf)
+	return buf, err
+}
+
+// resize returns buf with length n, reallocating only when it is too small.
+func resize(buf []byte, n int) []byte {
+	if cap(buf) < n {
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
@@ -0,0 +1,874 @@
+package Netpbm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSaveGeneratorComment(t *testing.T) {
+	pgm := newPGMFrom(255, []uint16{1, 2}, []uint16{3, 4})
+	pgm.AddComment("scanned by test")
+	filename := filepath.Join(t.TempDir(), "out.pgm")
+	if err := pgm.SaveWithOptions(filename, SaveOptions{WriteGeneratorComment: true}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(content), "\n")
+	if lines[1] != "# "+GeneratorComment || lines[2] != "# scanned by test" {
+		t.Errorf("header lines = %q, want the generator comment then the custom one", lines[:3])
+	}
+
+	decoded, err := ReadPGM(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pgm.Equal(decoded) {
+		t.Error("image with comments did not decode back to the original")
+	}
+}
+
+func TestSaveOmitsGeneratorCommentByDefault(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "out.pgm")
+	if err := NewPGM(2, 2, 255).Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), GeneratorComment) {
+		t.Errorf("default save wrote the generator comment:\n%s", content)
+	}
+}
+
+// encodeWithProcs encodes img with GOMAXPROCS set to procs, which decides
+// whether packRows takes its serial or its parallel path.
+func encodeWithProcs(t testing.TB, procs int, img io.WriterTo) []byte {
+	t.Helper()
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+	var buf bytes.Buffer
+	if _, err := img.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParallelPackMatchesSerial(t *testing.T) {
+	const width, height = 400, 200
+	for _, max := range []uint16{255, 65535} {
+		ppm := NewPPM(width, height, max)
+		pgm := NewPGM(width, height, max)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				v := uint16((x*7 + y*13) % (int(max) + 1))
+				ppm.Set(x, y, Pixel{v, max - v, uint16(x*y) % max})
+				pgm.Set(x, y, v)
+			}
+		}
+		ppm.SetMagicNumber("P6")
+		pgm.SetMagicNumber("P5")
+
+		for _, img := range []io.WriterTo{ppm, pgm} {
+			serial := encodeWithProcs(t, 1, img)
+			parallel := encodeWithProcs(t, 4, img)
+			if !bytes.Equal(serial, parallel) {
+				t.Errorf("%T max %d: parallel output differs from serial output", img, max)
+			}
+		}
+	}
+}
+
+func BenchmarkSaveP6Large(b *testing.B) {
+	ppm := NewPPM(5000, 5000, 255)
+	ppm.SetMagicNumber("P6")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ppm.WriteTo(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSaveP5Large(b *testing.B) {
+	pgm := NewPGM(5000, 5000, 255)
+	pgm.SetMagicNumber("P5")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := pgm.WriteTo(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeStatsRowCount(t *testing.T) {
+	dir := t.TempDir()
+	pgm := NewPGM(7, 5, 255)
+	pgm.SetMagicNumber("P5")
+	ppm := NewPPM(4, 9, 255)
+	pbm := NewPBM(10, 3)
+	pgmFile := filepath.Join(dir, "a.pgm")
+	ppmFile := filepath.Join(dir, "a.ppm")
+	pbmFile := filepath.Join(dir, "a.pbm")
+	for filename, save := range map[string]func(string) error{pgmFile: pgm.Save, ppmFile: ppm.Save, pbmFile: pbm.Save} {
+		if err := save(filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stats DecodeStats
+	if _, err := ReadPGMWithOptions(pgmFile, ReadOptions{Stats: &stats}); err != nil {
+		t.Fatal(err)
+	}
+	if stats.RowsDecoded != 5 || stats.BytesRead == 0 {
+		t.Errorf("PGM stats = %+v, want 5 rows and a non-zero byte count", stats)
+	}
+	if _, err := ReadPPMWithOptions(ppmFile, ReadOptions{Stats: &stats}); err != nil {
+		t.Fatal(err)
+	}
+	if stats.RowsDecoded != 9 {
+		t.Errorf("PPM rows decoded = %d, want 9", stats.RowsDecoded)
+	}
+	if _, err := ReadPBMWithOptions(pbmFile, ReadOptions{Stats: &stats}); err != nil {
+		t.Fatal(err)
+	}
+	if stats.RowsDecoded != 3 {
+		t.Errorf("PBM rows decoded = %d, want 3", stats.RowsDecoded)
+	}
+}
+
+func TestDimensionsOnSeparateLines(t *testing.T) {
+	pgm, err := ReadPGMFrom(strings.NewReader("P2\n3\n2\n9\n1 2 3\n4 5 6\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := pgm.Size(); w != 3 || h != 2 || pgm.At(2, 1) != 6 {
+		t.Errorf("PGM size %dx%d, At(2,1) = %d, want 3x2 and 6", w, h, pgm.At(2, 1))
+	}
+
+	ppm, err := ReadPPMFrom(strings.NewReader("P3\n1\t\n\n2 255\n1 2 3\n4 5 6\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := ppm.Size(); w != 1 || h != 2 || ppm.At(0, 1) != (Pixel{4, 5, 6}) {
+		t.Errorf("PPM size %dx%d, At(0,1) = %v, want 1x2 and {4 5 6}", w, h, ppm.At(0, 1))
+	}
+
+	pbm, err := ReadPBMFrom(strings.NewReader("P1\n2\n2\n10\n01\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := pbm.Size(); w != 2 || h != 2 || !pbm.At(1, 1) {
+		t.Errorf("PBM size %dx%d, want 2x2 with (1,1) set", w, h)
+	}
+}
+
+func TestHeaderComments(t *testing.T) {
+	pgm, err := ReadPGMFrom(strings.NewReader("P2\n# created by GIMP\n\n3 # width\n# between\n1\n# max next\n255 # trailing\n7 8 9\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := pgm.Size(); w != 3 || h != 1 || pgm.At(2, 0) != 9 {
+		t.Errorf("PGM size %dx%d, At(2,0) = %d, want 3x1 and 9", w, h, pgm.At(2, 0))
+	}
+
+	ppm, err := ReadPPMFrom(strings.NewReader("P6 # binary\n# ImageMagick\n1 1\n#max\n255\nabc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ppm.At(0, 0); got != (Pixel{'a', 'b', 'c'}) {
+		t.Errorf("PPM pixel = %v, want {97 98 99}", got)
+	}
+}
+
+func TestRoundTrip16Bit(t *testing.T) {
+	dir := t.TempDir()
+	for _, magic := range []string{"P5", "P2"} {
+		pgm := NewPGM(3, 2, 65535)
+		pgm.SetMagicNumber(magic)
+		for i, v := range []uint16{0, 1, 256, 4660, 65534, 65535} {
+			pgm.Set(i%3, i/3, v)
+		}
+		filename := filepath.Join(dir, magic+".pgm")
+		if err := pgm.Save(filename); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := ReadPGM(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pgm.Equal(decoded) {
+			t.Errorf("%s 16-bit PGM did not round-trip", magic)
+		}
+	}
+
+	for _, magic := range []string{"P6", "P3"} {
+		ppm := NewPPM(2, 2, 65535)
+		ppm.SetMagicNumber(magic)
+		ppm.Set(0, 0, Pixel{65535, 0, 1})
+		ppm.Set(1, 0, Pixel{256, 255, 4660})
+		ppm.Set(0, 1, Pixel{65534, 32768, 0x00FF})
+		filename := filepath.Join(dir, magic+".ppm")
+		if err := ppm.Save(filename); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := ReadPPM(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ppm.Equal(decoded) {
+			t.Errorf("%s 16-bit PPM did not round-trip", magic)
+		}
+	}
+
+	// Binary samples are big-endian, two bytes each.
+	ppm := NewPPM(1, 1, 65535)
+	ppm.SetMagicNumber("P6")
+	ppm.Set(0, 0, Pixel{0x1234, 0xABCD, 0x00FF})
+	var buf bytes.Buffer
+	if _, err := ppm.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if payload := buf.Bytes()[buf.Len()-6:]; !bytes.Equal(payload, []byte{0x12, 0x34, 0xAB, 0xCD, 0x00, 0xFF}) {
+		t.Errorf("P6 payload = % x, want 12 34 ab cd 00 ff", payload)
+	}
+}
+
+func TestConstructors(t *testing.T) {
+	ppm := NewPPM(5, 3, 255)
+	pgm := NewPGM(5, 3, 255)
+	pbm := NewPBM(5, 3)
+	for name, size := range map[string]func() (int, int){"PPM": ppm.Size, "PGM": pgm.Size, "PBM": pbm.Size} {
+		if w, h := size(); w != 5 || h != 3 {
+			t.Errorf("%s size = %dx%d, want 5x3", name, w, h)
+		}
+	}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 5; x++ {
+			if ppm.At(x, y) != (Pixel{}) || pgm.At(x, y) != 0 || pbm.At(x, y) {
+				t.Fatalf("pixel (%d,%d) is not zero", x, y)
+			}
+		}
+	}
+}
+
+func TestFourCCWRotationsRestoreImage(t *testing.T) {
+	ppm := NewPPM(4, 3, 255)
+	pgm := NewPGM(4, 3, 255)
+	pbm := NewPBM(4, 3)
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 4; x++ {
+			ppm.Set(x, y, Pixel{uint16(x), uint16(y), uint16(x * y)})
+			pgm.Set(x, y, uint16(y*4+x))
+			pbm.Set(x, y, (x+2*y)%3 == 0)
+		}
+	}
+	ppmCopy, pgmCopy, pbmCopy := ppm.Clone(), pgm.Clone(), pbm.Clone()
+
+	ppm.Rotate90CCW()
+	pgm.Rotate90CCW()
+	pbm.Rotate90CCW()
+	if ppm.At(0, 3) != ppmCopy.At(0, 0) || pgm.At(0, 3) != pgmCopy.At(0, 0) || pbm.At(0, 3) != pbmCopy.At(0, 0) {
+		t.Error("Rotate90CCW did not move the top-left pixel to the bottom-left")
+	}
+	for i := 0; i < 3; i++ {
+		ppm.Rotate90CCW()
+		pgm.Rotate90CCW()
+		pbm.Rotate90CCW()
+	}
+	if !ppm.Equal(ppmCopy) || !pgm.Equal(pgmCopy) || !pbm.Equal(pbmCopy) {
+		t.Error("four Rotate90CCW calls did not restore the original")
+	}
+
+	ppm.Rotate180()
+	pgm.Rotate180()
+	pbm.Rotate180()
+	if ppm.At(3, 2) != ppmCopy.At(0, 0) || pgm.At(3, 2) != pgmCopy.At(0, 0) || pbm.At(3, 2) != pbmCopy.At(0, 0) {
+		t.Error("Rotate180 did not move the top-left pixel to the bottom-right")
+	}
+}
+
+func TestAlignColumns(t *testing.T) {
+	dir := t.TempDir()
+	pgm := newPGMFrom(1000, []uint16{0, 7, 1000}, []uint16{42, 999, 5})
+	ppm := NewPPM(2, 1, 255)
+	ppm.Set(0, 0, Pixel{1, 20, 255})
+	ppm.Set(1, 0, Pixel{0, 100, 9})
+	for filename, tc := range map[string]struct {
+		save  func(string, SaveOptions) error
+		width int
+	}{
+		filepath.Join(dir, "a.pgm"): {pgm.SaveWithOptions, 4},
+		filepath.Join(dir, "a.ppm"): {ppm.SaveWithOptions, 3},
+	} {
+		if err := tc.save(filename, SaveOptions{AlignColumns: true}); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		for _, line := range lines[3:] {
+			for _, field := range strings.Fields(line) {
+				if len(field) != tc.width {
+					t.Errorf("%s: sample %q is not padded to %d digits", filepath.Base(filename), field, tc.width)
+				}
+			}
+		}
+	}
+
+	decoded, err := ReadPGM(filepath.Join(dir, "a.pgm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(pgm) {
+		t.Error("aligned PGM did not decode back to the original")
+	}
+}
+
+func TestReadFromMatchesFile(t *testing.T) {
+	dir := t.TempDir()
+	ppm := NewPPM(3, 2, 255)
+	ppm.SetMagicNumber("P6")
+	ppm.Set(2, 1, Pixel{9, 8, 7})
+	pgm := newPGMFrom(255, []uint16{1, 2, 3}, []uint16{4, 5, 6})
+	pbm := newPBMFrom("101", "010")
+	pbm.SetMagicNumber("P4")
+
+	files := map[string]func(string) error{"a.ppm": ppm.Save, "a.pgm": pgm.Save, "a.pbm": pbm.Save}
+	buffers := make(map[string]*bytes.Buffer)
+	for name, save := range files {
+		filename := filepath.Join(dir, name)
+		if err := save(filename); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffers[name] = bytes.NewBuffer(content)
+	}
+
+	fromFile, err := ReadPPM(filepath.Join(dir, "a.ppm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromBuffer, err := ReadPPMFrom(buffers["a.ppm"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromBuffer.Equal(fromFile) || !fromBuffer.Equal(ppm) {
+		t.Error("ReadPPMFrom differs from ReadPPM")
+	}
+
+	pgmFile, err := ReadPGM(filepath.Join(dir, "a.pgm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgmBuffer, err := ReadPGMFrom(buffers["a.pgm"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pgmBuffer.Equal(pgmFile) || !pgmBuffer.Equal(pgm) {
+		t.Error("ReadPGMFrom differs from ReadPGM")
+	}
+
+	pbmFile, err := ReadPBM(filepath.Join(dir, "a.pbm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbmBuffer, err := ReadPBMFrom(buffers["a.pbm"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pbmBuffer.Equal(pbmFile) || !pbmBuffer.Equal(pbm) {
+		t.Error("ReadPBMFrom differs from ReadPBM")
+	}
+}
+
+func TestWriteToMatchesSave(t *testing.T) {
+	dir := t.TempDir()
+	ppm := NewPPM(3, 2, 255)
+	ppm.Set(1, 1, Pixel{10, 20, 30})
+	pgm := newPGMFrom(65535, []uint16{1, 300}, []uint16{65535, 0})
+	pgm.SetMagicNumber("P5")
+	pbm := newPBMFrom("1011", "0100")
+	pbm.SetMagicNumber("P4")
+
+	for name, img := range map[string]interface {
+		io.WriterTo
+		Save(string) error
+	}{"a.ppm": ppm, "a.pgm": pgm, "a.pbm": pbm} {
+		filename := filepath.Join(dir, name)
+		if err := img.Save(filename); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		n, err := img.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), content) {
+			t.Errorf("%s: WriteTo output differs from the saved file", name)
+		}
+		if n != int64(len(content)) {
+			t.Errorf("%s: WriteTo reported %d bytes, wrote %d", name, n, len(content))
+		}
+	}
+}
+
+func TestCrop(t *testing.T) {
+	newImages := func() (*PPM, *PGM, *PBM) {
+		ppm := NewPPM(4, 3, 100)
+		pgm := NewPGM(4, 3, 100)
+		pbm := NewPBM(4, 3)
+		for y := 0; y < 3; y++ {
+			for x := 0; x < 4; x++ {
+				ppm.Set(x, y, Pixel{uint16(x), uint16(y), 0})
+				pgm.Set(x, y, uint16(y*4+x))
+				pbm.Set(x, y, (x+y)%2 == 1)
+			}
+		}
+		return ppm, pgm, pbm
+	}
+
+	for _, r := range []struct{ x, y, w, h int }{{0, 0, 2, 2}, {2, 1, 2, 2}, {1, 1, 2, 1}} {
+		ppm, pgm, pbm := newImages()
+		for _, crop := range []func(x, y, w, h int) error{ppm.Crop, pgm.Crop, pbm.Crop} {
+			if err := crop(r.x, r.y, r.w, r.h); err != nil {
+				t.Fatalf("Crop(%d, %d, %d, %d): %v", r.x, r.y, r.w, r.h, err)
+			}
+		}
+		for _, size := range []func() (int, int){ppm.Size, pgm.Size, pbm.Size} {
+			if w, h := size(); w != r.w || h != r.h {
+				t.Errorf("Crop(%d, %d, %d, %d) size = %dx%d", r.x, r.y, r.w, r.h, w, h)
+			}
+		}
+		for y := 0; y < r.h; y++ {
+			for x := 0; x < r.w; x++ {
+				sx, sy := r.x+x, r.y+y
+				if ppm.At(x, y) != (Pixel{uint16(sx), uint16(sy), 0}) || pgm.At(x, y) != uint16(sy*4+sx) || pbm.At(x, y) != ((sx+sy)%2 == 1) {
+					t.Errorf("Crop(%d, %d, %d, %d): pixel (%d,%d) does not match source (%d,%d)", r.x, r.y, r.w, r.h, x, y, sx, sy)
+				}
+			}
+		}
+		if ppm.max != 100 || pgm.max != 100 || ppm.magicNumber != "P3" || pgm.magicNumber != "P2" || pbm.magicNumber != "P1" {
+			t.Error("Crop did not preserve the max value and magic number")
+		}
+	}
+
+	ppm, pgm, pbm := newImages()
+	for _, crop := range []func(x, y, w, h int) error{ppm.Crop, pgm.Crop, pbm.Crop} {
+		if err := crop(3, 1, 2, 2); err == nil {
+			t.Error("out-of-bounds Crop succeeded, want an error")
+		}
+	}
+	if w, h := ppm.Size(); w != 4 || h != 3 {
+		t.Errorf("failed Crop changed the size to %dx%d", w, h)
+	}
+}
+
+func TestAssumeMaxVal255(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "legacy.pgm")
+	if err := os.WriteFile(filename, []byte("P2\n3 2\n10 20 30\n40 50 60\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPGM(filename); err == nil {
+		t.Error("strict read of a file without a max value succeeded, want an error")
+	}
+	pgm, err := ReadPGMWithOptions(filename, ReadOptions{AssumeMaxVal255: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := newPGMFrom(255, []uint16{10, 20, 30}, []uint16{40, 50, 60})
+	if diff, err := pgm.Diff(want); err != nil || diff != 0 || pgm.max != 255 {
+		t.Errorf("lenient read = %v max %d, want %v max 255", pgm.data, pgm.max, want.data)
+	}
+
+	binary := filepath.Join(t.TempDir(), "legacy.ppm")
+	if err := os.WriteFile(binary, []byte("P6\n2 1\nabcdef"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ppm, err := ReadPPMWithOptions(binary, ReadOptions{AssumeMaxVal255: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ppm.At(0, 0) != (Pixel{'a', 'b', 'c'}) || ppm.At(1, 0) != (Pixel{'d', 'e', 'f'}) {
+		t.Errorf("lenient P6 read = %v", ppm.data)
+	}
+}
+
+func TestCloneIsDeep(t *testing.T) {
+	ppm := NewPPM(2, 2, 255)
+	pgm := NewPGM(2, 2, 255)
+	pbm := NewPBM(2, 2)
+
+	ppmClone, pgmClone, pbmClone := ppm.Clone(), pgm.Clone(), pbm.Clone()
+	ppmClone.Set(1, 1, white)
+	ppmClone.Invert()
+	pgmClone.Set(0, 1, 9)
+	pgmClone.Rotate90CW()
+	pbmClone.Set(1, 0, true)
+
+	if ppm.At(1, 1) != (Pixel{}) || ppm.At(0, 0) != (Pixel{}) {
+		t.Error("mutating the PPM clone changed the original")
+	}
+	if pgm.At(0, 1) != 0 {
+		t.Error("mutating the PGM clone changed the original")
+	}
+	if pbm.At(1, 0) {
+		t.Error("mutating the PBM clone changed the original")
+	}
+}
+
+func TestEqualAndDiff(t *testing.T) {
+	a, b := NewPGM(3, 2, 255), NewPGM(3, 2, 255)
+	if !a.Equal(b) {
+		t.Error("identical PGM images are not Equal")
+	}
+	b.Set(2, 1, 1)
+	if diff, err := a.Diff(b); err != nil || diff != 1 || a.Equal(b) {
+		t.Errorf("one-pixel PGM difference: Diff = %d, %v; Equal = %v", diff, err, a.Equal(b))
+	}
+	if _, err := a.Diff(NewPGM(2, 3, 255)); err == nil {
+		t.Error("PGM Diff of mismatched dimensions succeeded")
+	}
+	if a.Equal(NewPGM(3, 2, 100)) {
+		t.Error("PGM images with different max values are Equal")
+	}
+
+	c, d := NewPPM(3, 2, 255), NewPPM(3, 2, 255)
+	if !c.Equal(d) {
+		t.Error("identical PPM images are not Equal")
+	}
+	d.Set(0, 0, Pixel{0, 0, 1})
+	if diff, err := c.Diff(d); err != nil || diff != 1 || c.Equal(d) {
+		t.Errorf("one-pixel PPM difference: Diff = %d, %v", diff, err)
+	}
+	if _, err := c.Diff(NewPPM(3, 3, 255)); err == nil {
+		t.Error("PPM Diff of mismatched dimensions succeeded")
+	}
+
+	e, f := NewPBM(3, 2), NewPBM(3, 2)
+	if !e.Equal(f) {
+		t.Error("identical PBM images are not Equal")
+	}
+	f.Set(1, 1, true)
+	if diff, err := e.Diff(f); err != nil || diff != 1 || e.Equal(f) {
+		t.Errorf("one-pixel PBM difference: Diff = %d, %v", diff, err)
+	}
+	if _, err := e.Diff(NewPBM(4, 2)); err == nil {
+		t.Error("PBM Diff of mismatched dimensions succeeded")
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "in.pgm")
+	if err := os.WriteFile(source, []byte("P2\n# dpi: 300\n# a plain comment\n2 1\n255\n1 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pgm, err := ReadPGM(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dpi, ok := pgm.GetMetadata("dpi"); !ok || dpi != "300" {
+		t.Fatalf("GetMetadata(dpi) = %q, %v, want 300", dpi, ok)
+	}
+	if err := pgm.SetMetadata("dpi", "600"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pgm.SetMetadata("source", "flatbed"); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := filepath.Join(dir, "out.pgm")
+	if err := pgm.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := ReadPGM(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"dpi": "600", "source": "flatbed"} {
+		if got, ok := reloaded.GetMetadata(key); !ok || got != want {
+			t.Errorf("after save, %s = %q, %v, want %q", key, got, ok, want)
+		}
+	}
+	if err := pgm.SetMetadata("bad\nkey", "x"); err == nil {
+		t.Error("SetMetadata accepted a key with a newline")
+	}
+}
+
+func TestPhysicalSize(t *testing.T) {
+	ppm := NewPPM(600, 300, 255)
+	if err := ppm.SetResolution(300, 300); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := ppm.PhysicalSize(); w != 2 || h != 1 {
+		t.Errorf("PhysicalSize() = %v x %v inches, want 2 x 1", w, h)
+	}
+
+	filename := filepath.Join(t.TempDir(), "scan.ppm")
+	if err := ppm.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := ReadPPM(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, y := reloaded.Resolution(); x != 300 || y != 300 {
+		t.Errorf("reloaded Resolution() = %v, %v, want 300, 300", x, y)
+	}
+	if w, h := NewPGM(10, 10, 255).PhysicalSize(); w != 0 || h != 0 {
+		t.Errorf("PhysicalSize without a resolution = %v, %v, want 0, 0", w, h)
+	}
+}
+
+func TestConvertStreamMatchesBuffered(t *testing.T) {
+	ppm := NewPPM(300, 200, 255)
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			ppm.Set(x, y, Pixel{uint16(x % 256), uint16(y), uint16((x * y) % 256)})
+		}
+	}
+	var p3 bytes.Buffer
+	if _, err := ppm.WriteTo(&p3); err != nil {
+		t.Fatal(err)
+	}
+
+	var streamed bytes.Buffer
+	if err := ConvertStream(bytes.NewReader(p3.Bytes()), &streamed, "P6"); err != nil {
+		t.Fatal(err)
+	}
+	buffered, err := ReadPPMFrom(bytes.NewReader(p3.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffered.SetMagicNumber("P6")
+	var want bytes.Buffer
+	if _, err := buffered.WriteTo(&want); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(streamed.Bytes(), want.Bytes()) {
+		t.Error("streamed P3 to P6 conversion differs from the buffered one")
+	}
+
+	if err := ConvertStream(bytes.NewReader(p3.Bytes()), io.Discard, "P5"); err == nil {
+		t.Error("converting a PPM to P5 succeeded, want an error")
+	}
+}
+
+func TestRotate90MatchesRotate90CW(t *testing.T) {
+	ppm := NewPPM(5, 3, 255)
+	pgm := NewPGM(5, 3, 255)
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 5; x++ {
+			ppm.Set(x, y, Pixel{uint16(x), uint16(y), 9})
+			pgm.Set(x, y, uint16(y*5+x))
+		}
+	}
+	ppmWant, pgmWant := ppm.Clone(), pgm.Clone()
+	ppmWant.Rotate90CW()
+	pgmWant.Rotate90CW()
+	ppmSrc, pgmSrc := ppm.Clone(), pgm.Clone()
+
+	ppm.Rotate(90, Pixel{1, 1, 1})
+	pgm.Rotate(90, 99)
+	if !ppm.Equal(ppmWant) {
+		t.Errorf("PPM Rotate(90) = %v, want %v", ppm.data, ppmWant.data)
+	}
+	if !pgm.Equal(pgmWant) {
+		t.Errorf("PGM Rotate(90) = %v, want %v", pgm.data, pgmWant.data)
+	}
+
+	// Rotate now takes the lossless path for quarter turns, so exercise the
+	// inverse mapping directly: at 90 degrees every output pixel lands
+	// exactly on a source pixel and must reproduce Rotate90CW.
+	for _, interp := range []Interpolation{NearestNeighbor, Bilinear} {
+		ppmMapped, pgmMapped := ppmSrc.Clone(), pgmSrc.Clone()
+		ppmMapped.rotateResampled(90, Pixel{1, 1, 1}, interp)
+		pgmMapped.rotateResampled(90, 99, interp)
+		if !ppmMapped.Equal(ppmWant) {
+			t.Errorf("PPM inverse mapping at 90 (interp %d) = %v, want %v", interp, ppmMapped.data, ppmWant.data)
+		}
+		if !pgmMapped.Equal(pgmWant) {
+			t.Errorf("PGM inverse mapping at 90 (interp %d) = %v, want %v", interp, pgmMapped.data, pgmWant.data)
+		}
+	}
+
+	// A 45 degree turn grows the canvas and fills the corners with bg.
+	square := NewPGM(10, 10, 255)
+	square.Rotate(45, 99)
+	if w, h := square.Size(); w < 14 || h < 14 {
+		t.Errorf("45 degree rotation is %dx%d, want it to contain the rotated bounds", w, h)
+	}
+	if square.At(0, 0) != 99 {
+		t.Errorf("corner = %d, want the background 99", square.At(0, 0))
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	newPGM := func() *PGM {
+		return newPGMFrom(255, []uint16{1, 2, 3, 4}, []uint16{5, 6, 7, 8}, []uint16{9, 10, 11, 12})
+	}
+	for _, tc := range []struct {
+		dx, dy int
+		mode   string
+		want   [][]uint16
+	}{
+		{1, 1, "wrap", [][]uint16{{12, 9, 10, 11}, {4, 1, 2, 3}, {8, 5, 6, 7}}},
+		{-2, -1, "wrap", [][]uint16{{7, 8, 5, 6}, {11, 12, 9, 10}, {3, 4, 1, 2}}},
+		{1, 1, "fill", [][]uint16{{0, 0, 0, 0}, {0, 1, 2, 3}, {0, 5, 6, 7}}},
+		{-2, -1, "fill", [][]uint16{{7, 8, 0, 0}, {11, 12, 0, 0}, {0, 0, 0, 0}}},
+	} {
+		pgm := newPGM()
+		if err := pgm.Translate(tc.dx, tc.dy, tc.mode, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pgm.data, tc.want) {
+			t.Errorf("PGM Translate(%d, %d, %s) = %v, want %v", tc.dx, tc.dy, tc.mode, pgm.data, tc.want)
+		}
+	}
+	if err := newPGM().Translate(1, 0, "mirror", 0); err == nil {
+		t.Error("unknown mode accepted")
+	}
+
+	ppm := NewPPM(3, 2, 255)
+	ppm.Set(2, 1, white)
+	if err := ppm.Translate(1, 1, "wrap", Pixel{}); err != nil {
+		t.Fatal(err)
+	}
+	if ppm.At(0, 0) != white {
+		t.Error("PPM wrap did not move the bottom-right pixel to the top-left")
+	}
+	fill := Pixel{9, 9, 9}
+	if err := ppm.Translate(-1, 0, "fill", fill); err != nil {
+		t.Fatal(err)
+	}
+	if ppm.At(2, 0) != fill || ppm.At(2, 1) != fill || ppm.At(0, 0) != (Pixel{}) {
+		t.Errorf("PPM fill shift = %v", ppm.data)
+	}
+
+	pbm := newPBMFrom("100", "000")
+	if err := pbm.Translate(-1, -1, "wrap", false); err != nil {
+		t.Fatal(err)
+	}
+	if !pbm.At(2, 1) {
+		t.Error("PBM wrap did not move the top-left pixel to the bottom-right")
+	}
+	if err := pbm.Translate(0, 1, "fill", true); err != nil {
+		t.Fatal(err)
+	}
+	if !pbm.At(0, 0) || !pbm.At(2, 0) || pbm.At(2, 1) {
+		t.Errorf("PBM fill shift = %v", pbm.data)
+	}
+}
+
+func TestReadFromShortReads(t *testing.T) {
+	for _, max := range []uint16{255, 1000} {
+		pgm := gradient(37, 9, max)
+		pgm.SetMagicNumber("P5")
+		ppm := numbered(37, 9)
+		ppm.SetMagicNumber("P6")
+		ppm.max = max
+
+		var pgmBuf, ppmBuf bytes.Buffer
+		if _, err := pgm.WriteTo(&pgmBuf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ppm.WriteTo(&ppmBuf); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, wrap := range map[string]func(io.Reader) io.Reader{
+			"one byte": iotest.OneByteReader,
+			"half":     iotest.HalfReader,
+		} {
+			gotPGM, err := ReadPGMFrom(wrap(bytes.NewReader(pgmBuf.Bytes())))
+			if err != nil {
+				t.Fatalf("P5 max %d, %s reader: %v", max, name, err)
+			}
+			if !gotPGM.Equal(pgm) {
+				t.Errorf("P5 max %d, %s reader: decoded image differs", max, name)
+			}
+			gotPPM, err := ReadPPMFrom(wrap(bytes.NewReader(ppmBuf.Bytes())))
+			if err != nil {
+				t.Fatalf("P6 max %d, %s reader: %v", max, name, err)
+			}
+			if !gotPPM.Equal(ppm) {
+				t.Errorf("P6 max %d, %s reader: decoded image differs", max, name)
+			}
+		}
+	}
+}
+
+func TestRotate270MatchesThreeQuarterTurns(t *testing.T) {
+	encode := func(img io.WriterTo) []byte {
+		var buf bytes.Buffer
+		if _, err := img.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	ppm := numbered(5, 3)
+	ppm.SetMagicNumber("P6")
+	want := ppm.Clone()
+	for i := 0; i < 3; i++ {
+		want.Rotate90CW()
+	}
+	rotated, turned := ppm.Clone(), ppm.Clone()
+	rotated.Rotate(270, Pixel{1, 1, 1})
+	turned.Rotate270CW()
+	if !bytes.Equal(encode(rotated), encode(want)) {
+		t.Errorf("PPM Rotate(270) = %v, want %v", rotated.data, want.data)
+	}
+	if !bytes.Equal(encode(turned), encode(want)) {
+		t.Errorf("PPM Rotate270CW = %v, want %v", turned.data, want.data)
+	}
+
+	pgm := gradient(5, 3, 255)
+	pgmWant := pgm.Clone()
+	for i := 0; i < 3; i++ {
+		pgmWant.Rotate90CW()
+	}
+	pgm.Rotate270CW()
+	if !bytes.Equal(encode(pgm), encode(pgmWant)) {
+		t.Errorf("PGM Rotate270CW = %v, want %v", pgm.data, pgmWant.data)
+	}
+
+	pbm := newPBMFrom(
+		"11000",
+		"00101",
+		"10011",
+	)
+	// PBM has no Rotate90CW, so spell out the three clockwise quarter turns.
+	pbmWant := newPBMFrom(
+		"011",
+		"001",
+		"010",
+		"100",
+		"101",
+	)
+	pbm.Rotate270CW()
+	if !bytes.Equal(encode(pbm), encode(pbmWant)) {
+		t.Errorf("PBM Rotate270CW = %v, want %v", pbm.data, pbmWant.data)
+	}
+}
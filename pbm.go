@@ -2,10 +2,14 @@ package Netpbm
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"image"
+	"io"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 )
 
 // PBM struct represents a PBM image.
@@ -13,11 +17,32 @@ type PBM struct {
 	data          [][]bool
 	width, height int
 	magicNumber   string
+	comments      []string
+	metadata      map[string]string
+}
+
+// NewPBM creates a blank (all unset) P1 PBM image of the given size.
+func NewPBM(width, height int) *PBM {
+	pbm := &PBM{
+		data:        make([][]bool, height),
+		width:       width,
+		height:      height,
+		magicNumber: "P1",
+	}
+	for y := range pbm.data {
+		pbm.data[y] = make([]bool, width)
+	}
+	return pbm
 }
 
 // ReadPBM reads the PBM image from a file and returns the image information in a struct.
 func ReadPBM(filename string) (*PBM, error) {
-	pbm := PBM{}
+	return ReadPBMWithOptions(filename, ReadOptions{})
+}
+
+// ReadPBMWithOptions reads the PBM image from a file using the given options.
+func ReadPBMWithOptions(filename string, opts ReadOptions) (*PBM, error) {
+	start := time.Now()
 
 	// Open the file
 	file, err := os.Open(filename)
@@ -25,104 +50,170 @@ func ReadPBM(filename string) (*PBM, error) {
 		return nil, fmt.Errorf("error opening file: %v", err)
 	}
 	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	confirmMagicNumber := false
-	confirmDimensions := false
-	line := 0
-
-	// Ignore all comments
-	for scanner.Scan() {
-		if scanner.Text() == "" {
-			continue
-		}
-
-		if strings.HasPrefix(scanner.Text(), "#") {
-			continue
-		} else if !confirmMagicNumber {
-			//Magic number
-			pbm.magicNumber = scanner.Text()
-			confirmMagicNumber = true
-		} else if !confirmDimensions {
-			//Size
-			separated := strings.Fields(scanner.Text())
-			if len(separated) > 0 {
-				pbm.width, _ = strconv.Atoi(separated[0])
-				pbm.height, _ = strconv.Atoi(separated[1])
-			}
-			confirmDimensions = true
-			pbm.data = make([][]bool, pbm.height)
-			for i := range pbm.data {
-				pbm.data[i] = make([]bool, pbm.width)
-			}
-
-		} else {
-			if pbm.magicNumber == "P1" {
-				//P1 format
-				parsedValues := strings.Fields(scanner.Text())
-				for i := 0; i < pbm.width; i++ {
-					pbm.data[line][i] = parsedValues[i] == "1"
-				}
-				line++
-			} else if pbm.magicNumber == "P4" {
-				//P4 format
-				err := processP4Format(file, &pbm)
+	return readPBM(file, opts, start)
+}
+
+// ReadPBMFrom reads a PBM image from r, such as an HTTP body or an in-memory buffer.
+func ReadPBMFrom(r io.Reader) (*PBM, error) {
+	return readPBM(r, ReadOptions{}, time.Now())
+}
+
+// readPBM parses a PBM image from r. start is when the read began, for DecodeStats.
+func readPBM(r io.Reader, opts ReadOptions, start time.Time) (*PBM, error) {
+	counter := &countingReader{reader: r}
+	rows := 0
+	defer func() { opts.Stats.record(counter.n, rows, start) }()
+	reader := bufio.NewReader(counter)
+
+	//Magic number
+	var comments []string
+	magicNumber, err := readHeaderToken(reader, &comments)
+	if err != nil {
+		return nil, fmt.Errorf("error reading magic number: %v", err)
+	}
+	if magicNumber != "P1" && magicNumber != "P4" {
+		return nil, fmt.Errorf("invalid magic number: %s", magicNumber)
+	}
+
+	//Size
+	width, height, err := readDimensions(reader, &comments)
+	if err != nil {
+		return nil, fmt.Errorf("error reading dimensions: %v", err)
+	}
+	pbm := NewPBM(width, height)
+	pbm.magicNumber = magicNumber
+
+	if magicNumber == "P1" {
+		//P1 format
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				bit, err := readBit(reader)
 				if err != nil {
-					return nil, fmt.Errorf("error processing P4 format: %v", err)
+					return nil, fmt.Errorf("error reading pixel at row %d, column %d: %v", y, x, err)
 				}
+				pbm.data[y][x] = bit == 1
+			}
+			rows++
+		}
+	} else {
+		//P4 format
+		var data io.Reader = reader
+		if next, err := reader.Peek(1); err == nil && next[0] == '#' {
+			// Only the data size can tell a comment line from pixel bytes
+			// that happen to start with '#', so buffer the rest to decide.
+			content, err := io.ReadAll(reader)
+			if err != nil {
+				return nil, fmt.Errorf("error reading data: %v", err)
 			}
+			data = bytes.NewReader(skipCommentLines(content, (width+7)/8*height, &comments))
+		}
+		err = processP4Format(data, pbm)
+		if err != nil {
+			return nil, fmt.Errorf("error processing P4 format: %v", err)
 		}
+		rows = height
 	}
-	return &pbm, nil
+	pbm.comments, pbm.metadata = splitMetadata(comments)
+	return pbm, nil
 }
 
-func processP4Format(file *os.File, pbm *PBM) error {
-	expectedBytesPerRow := (pbm.width + 7) / 8
-	totalExpectedBytes := expectedBytesPerRow * pbm.height
-	fmt.Printf("Expected total bytes for pixel data: %d\n", totalExpectedBytes)
-	allPixelData := make([]byte, totalExpectedBytes)
-	fileContent, err := os.ReadFile(file.Name())
-	if err != nil {
-		return fmt.Errorf("error reading file: %v", err)
+// skipCommentLines strips whole "#" comment lines from the start of the binary
+// data that follows a P4 header, appending their text to comments. The packed
+// pixels begin right after the whitespace that ends the height, and their first
+// byte may itself be '#', so lines are only taken as comments while more than
+// size bytes remain.
+func skipCommentLines(content []byte, size int, comments *[]string) []byte {
+	for len(content) > size && content[0] == '#' {
+		end := bytes.IndexByte(content, '\n')
+		if end < 0 || len(content)-end-1 < size {
+			break
+		}
+		*comments = append(*comments, strings.TrimSpace(string(content[1:end])))
+		content = content[end+1:]
 	}
-	copy(allPixelData, fileContent[len(fileContent)-totalExpectedBytes:])
-	byteIndex := 0
+	return content
+}
+
+// processP4Format reads the packed P4 rows from reader: (width+7)/8 bytes
+// per row, most significant bit first. The padding bits at the end of each
+// row are ignored.
+func processP4Format(reader io.Reader, pbm *PBM) error {
+	row := make([]byte, (pbm.width+7)/8)
 	for y := 0; y < pbm.height; y++ {
+		_, err := io.ReadFull(reader, row)
+		if err != nil {
+			return fmt.Errorf("unexpected end of data at row %d: expected %d bytes per row: %v", y, len(row), err)
+		}
 		for x := 0; x < pbm.width; x++ {
-			if x%8 == 0 && x != 0 {
-				byteIndex++
-			}
-			pbm.data[y][x] = (allPixelData[byteIndex]>>(7-(x%8)))&1 != 0
+			pbm.data[y][x] = row[x/8]>>(7-x%8)&1 != 0
 		}
-		byteIndex++
 	}
 	return nil
 }
 
-// Size returns the height and width of the image.
+// Size returns the width and height of the image, in the same order as PGM and PPM.
 func (pbm *PBM) Size() (int, int) {
-	return pbm.height, pbm.width
+	return pbm.width, pbm.height
 }
 
-// At returns the value of each pixel at (x, y).
+// At returns the value of the pixel at column x and row y.
+// It returns false for coordinates outside the image.
 func (pbm *PBM) At(x, y int) bool {
-	return pbm.data[x][y]
+	if x >= 0 && x < pbm.width && y >= 0 && y < pbm.height {
+		return pbm.data[y][x]
+	}
+	return false
 }
 
-// Set sets the value of each pixel at (x, y).
+// Set sets the value of the pixel at column x and row y.
+// Coordinates outside the image are ignored.
 func (pbm *PBM) Set(x, y int, value bool) {
-	pbm.data[x][y] = value
+	if x >= 0 && x < pbm.width && y >= 0 && y < pbm.height {
+		pbm.data[y][x] = value
+	}
 }
 
 // Save saves the PBM image to a file and returns an error if there was a problem.
 func (pbm *PBM) Save(filename string) error {
+	return pbm.SaveWithOptions(filename, SaveOptions{})
+}
+
+// SaveWithOptions saves the PBM image to a file using the given options.
+func (pbm *PBM) SaveWithOptions(filename string, opts SaveOptions) error {
 	file, err := os.Create(filename)
 	if err != nil {
 		return fmt.Errorf("error creating file: %v", err)
 	}
 	defer file.Close()
-	_, err = fmt.Fprintf(file, "%s\n%d %d\n", pbm.magicNumber, pbm.width, pbm.height)
+	_, err = pbm.writeTo(file, opts)
+	return err
+}
+
+// WriteTo writes the PBM image to w in its current format and returns the
+// number of bytes written. It implements io.WriterTo.
+func (pbm *PBM) WriteTo(w io.Writer) (int64, error) {
+	return pbm.writeTo(w, SaveOptions{})
+}
+
+func (pbm *PBM) writeTo(w io.Writer, opts SaveOptions) (int64, error) {
+	return writeBuffered(w, func(writer *bufio.Writer) error {
+		return pbm.encode(writer, opts)
+	})
+}
+
+// encode writes the header and pixel data to file.
+func (pbm *PBM) encode(file *bufio.Writer, opts SaveOptions) error {
+	_, err := fmt.Fprintf(file, "%s\n", pbm.magicNumber)
+	if err != nil {
+		return fmt.Errorf("error writing magic number: %v", err)
+	}
+	err = writeComments(file, pbm.comments, pbm.metadata, opts)
 	if err != nil {
-		return fmt.Errorf("error writing magic number and dimensions: %v", err)
+		return err
+	}
+	_, err = fmt.Fprintf(file, "%d %d\n", pbm.width, pbm.height)
+	if err != nil {
+		return fmt.Errorf("error writing dimensions: %v", err)
 	}
 	if pbm.magicNumber == "P1" {
 		err := writeP1Format(file, pbm)
@@ -139,7 +230,7 @@ func (pbm *PBM) Save(filename string) error {
 	return nil
 }
 
-func writeP1Format(file *os.File, pbm *PBM) error {
+func writeP1Format(file *bufio.Writer, pbm *PBM) error {
 	for _, row := range pbm.data {
 		for _, pixel := range row {
 			if pixel {
@@ -162,7 +253,10 @@ func writeP1Format(file *os.File, pbm *PBM) error {
 	return nil
 }
 
-func writeP4Format(file *os.File, pbm *PBM) error {
+// writeP4Format packs each row into (width+7)/8 bytes, most significant bit
+// first, as processP4Format reads them. The padding bits at the end of a row
+// whose width is not a multiple of 8 are written as zero.
+func writeP4Format(file *bufio.Writer, pbm *PBM) error {
 	for _, row := range pbm.data {
 		for x := 0; x < pbm.width; x += 8 {
 			var byteValue byte
@@ -172,7 +266,7 @@ func writeP4Format(file *os.File, pbm *PBM) error {
 					byteValue |= 1 << bitIndex
 				}
 			}
-			_, err := file.Write([]byte{byteValue})
+			err := file.WriteByte(byteValue)
 			if err != nil {
 				return fmt.Errorf("error writing pixel data: %v", err)
 			}
@@ -190,6 +284,35 @@ func (pbm *PBM) Invert() {
 	}
 }
 
+// AutoPolarity normalizes a scan to dark ink on a white background by
+// inverting it when more than half of its pixels are set. It reports whether
+// the image was inverted.
+func (pbm *PBM) AutoPolarity() bool {
+	return pbm.AutoPolarityThreshold(0.5)
+}
+
+// AutoPolarityThreshold inverts the image when the fraction of set pixels
+// exceeds threshold, and reports whether it did.
+func (pbm *PBM) AutoPolarityThreshold(threshold float64) bool {
+	total := pbm.width * pbm.height
+	if total == 0 {
+		return false
+	}
+	set := 0
+	for _, row := range pbm.data {
+		for _, pixel := range row {
+			if pixel {
+				set++
+			}
+		}
+	}
+	if float64(set)/float64(total) <= threshold {
+		return false
+	}
+	pbm.Invert()
+	return true
+}
+
 // Flip flips the PBM image horizontally.
 func (pbm *PBM) Flip() {
 	for y := 0; y < pbm.height; y++ {
@@ -217,7 +340,365 @@ func (pbm *PBM) Flop() {
 	}
 }
 
+// Rotate90CCW rotates the PBM image 90 degrees counterclockwise.
+func (pbm *PBM) Rotate90CCW() {
+	if pbm.width <= 0 || pbm.height <= 0 {
+		return
+	}
+
+	newData := make([][]bool, pbm.width)
+	for i := 0; i < pbm.width; i++ {
+		newData[pbm.width-1-i] = make([]bool, pbm.height)
+		for j := 0; j < pbm.height; j++ {
+			newData[pbm.width-1-i][j] = pbm.data[j][i]
+		}
+	}
+	pbm.data = newData
+	pbm.width, pbm.height = pbm.height, pbm.width
+}
+
+// Rotate270CW rotates the PBM image 270 degrees clockwise. It is the same as
+// Rotate90CCW.
+func (pbm *PBM) Rotate270CW() {
+	pbm.Rotate90CCW()
+}
+
+// Rotate180 rotates the PBM image 180 degrees in place.
+func (pbm *PBM) Rotate180() {
+	pbm.Flip()
+	pbm.Flop()
+}
+
 // SetMagicNumber sets the magic number of the PBM image.
 func (pbm *PBM) SetMagicNumber(magicNumber string) {
 	pbm.magicNumber = magicNumber
 }
+
+// AddComment adds a comment line written to the header on Save.
+func (pbm *PBM) AddComment(comment string) {
+	pbm.comments = append(pbm.comments, comment)
+}
+
+// SetMetadata stores a key/value pair that is written to the header as a
+// "# key: value" comment and read back into the metadata on load. Keys are a
+// single word of letters, digits, '-', '_' or '.'; values must fit on one
+// line.
+func (pbm *PBM) SetMetadata(key, value string) error {
+	return setMetadata(&pbm.metadata, key, value)
+}
+
+// GetMetadata returns the metadata value stored under key.
+func (pbm *PBM) GetMetadata(key string) (string, bool) {
+	value, ok := pbm.metadata[key]
+	return value, ok
+}
+
+// SetResolution records the physical resolution in dots per inch, stored as
+// "dpi" metadata since Netpbm has no native field for it.
+func (pbm *PBM) SetResolution(dpiX, dpiY float64) error {
+	return setResolution(&pbm.metadata, dpiX, dpiY)
+}
+
+// Resolution returns the horizontal and vertical resolution in dots per inch,
+// or zeros when none is recorded.
+func (pbm *PBM) Resolution() (float64, float64) {
+	return resolution(pbm.metadata)
+}
+
+// PhysicalSize returns the printed width and height in inches, or zeros when
+// no resolution is recorded.
+func (pbm *PBM) PhysicalSize() (float64, float64) {
+	return physicalSize(pbm.width, pbm.height, pbm.metadata)
+}
+
+// brailleDots maps a pixel position inside a 2x4 cell to its Braille dot bit.
+var brailleDots = [4][2]rune{
+	{0x01, 0x08},
+	{0x02, 0x10},
+	{0x04, 0x20},
+	{0x40, 0x80},
+}
+
+// ToBraille renders the PBM image as text, one Unicode Braille character per
+// 2x4 block of pixels, with set pixels shown as raised dots.
+func (pbm *PBM) ToBraille() string {
+	var builder strings.Builder
+	for y := 0; y < pbm.height; y += 4 {
+		for x := 0; x < pbm.width; x += 2 {
+			char := rune(0x2800)
+			for dy := 0; dy < 4 && y+dy < pbm.height; dy++ {
+				for dx := 0; dx < 2 && x+dx < pbm.width; dx++ {
+					if pbm.data[y+dy][x+dx] {
+						char |= brailleDots[dy][dx]
+					}
+				}
+			}
+			builder.WriteRune(char)
+		}
+		builder.WriteByte('\n')
+	}
+	return builder.String()
+}
+
+// ClearRect fills the rectangle r with a single value, clipped to the image bounds.
+func (pbm *PBM) ClearRect(r image.Rectangle, value bool) {
+	r = r.Intersect(image.Rect(0, 0, pbm.width, pbm.height))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			pbm.data[y][x] = value
+		}
+	}
+}
+
+// Crop replaces the image with the sub-rectangle [x, x+w) x [y, y+h). It
+// returns an error, leaving the image unchanged, if the rectangle is empty or
+// extends outside the image.
+func (pbm *PBM) Crop(x, y, w, h int) error {
+	err := checkCrop(x, y, w, h, pbm.width, pbm.height)
+	if err != nil {
+		return err
+	}
+	data := make([][]bool, h)
+	for row := range data {
+		data[row] = make([]bool, w)
+		copy(data[row], pbm.data[y+row][x:x+w])
+	}
+	pbm.data = data
+	pbm.width, pbm.height = w, h
+	return nil
+}
+
+// Clone returns a deep copy of the image that shares no memory with it.
+func (pbm *PBM) Clone() *PBM {
+	clone := &PBM{
+		data:        make([][]bool, len(pbm.data)),
+		width:       pbm.width,
+		height:      pbm.height,
+		magicNumber: pbm.magicNumber,
+		comments:    append([]string(nil), pbm.comments...),
+		metadata:    copyMetadata(pbm.metadata),
+	}
+	for y, row := range pbm.data {
+		clone.data[y] = append([]bool(nil), row...)
+	}
+	return clone
+}
+
+// Equal reports whether other has the same dimensions, magic number
+// and pixels. Comments are not compared.
+func (pbm *PBM) Equal(other *PBM) bool {
+	if other == nil || pbm.magicNumber != other.magicNumber {
+		return false
+	}
+	diff, err := pbm.Diff(other)
+	return err == nil && diff == 0
+}
+
+// Diff returns the number of pixels that differ between the image and other.
+// It returns an error if the dimensions do not match.
+func (pbm *PBM) Diff(other *PBM) (int, error) {
+	if other == nil || pbm.width != other.width || pbm.height != other.height {
+		return 0, fmt.Errorf("cannot diff images of different dimensions")
+	}
+	count := 0
+	for y := 0; y < pbm.height; y++ {
+		for x := 0; x < pbm.width; x++ {
+			if pbm.data[y][x] != other.data[y][x] {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// Render converts the PBM image to a PPM image, drawing set pixels with fg
+// and unset pixels with bg.
+func (pbm *PBM) Render(fg, bg Pixel) *PPM {
+	ppm := NewPPM(pbm.width, pbm.height, 255)
+	for y := 0; y < pbm.height; y++ {
+		for x := 0; x < pbm.width; x++ {
+			if pbm.data[y][x] {
+				ppm.data[y][x] = fg
+			} else {
+				ppm.data[y][x] = bg
+			}
+		}
+	}
+	return ppm
+}
+
+// ToPPM converts the PBM image to a max-255 P3 PPM image, mapping set (black)
+// pixels to on and unset (white) pixels to off. It is equivalent to Render.
+func (pbm *PBM) ToPPM(on, off Pixel) *PPM {
+	return pbm.Render(on, off)
+}
+
+// ToPGM converts the PBM image to a P2 PGM image with the given max value.
+// Set (black) pixels become 0 and unset (white) pixels become max.
+func (pbm *PBM) ToPGM(max uint16) *PGM {
+	pgm := NewPGM(pbm.width, pbm.height, max)
+	for y := 0; y < pbm.height; y++ {
+		for x := 0; x < pbm.width; x++ {
+			if !pbm.data[y][x] {
+				pgm.data[y][x] = max
+			}
+		}
+	}
+	return pgm
+}
+
+// labelComponents labels the 8-connected components of set pixels. It
+// returns a grid holding each pixel's component number (0 for unset pixels,
+// components start at 1) and the pixel count of each component by number.
+func (pbm *PBM) labelComponents() ([][]int, []int) {
+	labels := make([][]int, pbm.height)
+	for y := range labels {
+		labels[y] = make([]int, pbm.width)
+	}
+	sizes := []int{0}
+	var stack []Point
+	for y := 0; y < pbm.height; y++ {
+		for x := 0; x < pbm.width; x++ {
+			if !pbm.data[y][x] || labels[y][x] != 0 {
+				continue
+			}
+			label := len(sizes)
+			sizes = append(sizes, 0)
+			labels[y][x] = label
+			stack = append(stack[:0], Point{x, y})
+			for len(stack) > 0 {
+				p := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				sizes[label]++
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						nx, ny := p.X+dx, p.Y+dy
+						if nx >= 0 && nx < pbm.width && ny >= 0 && ny < pbm.height && pbm.data[ny][nx] && labels[ny][nx] == 0 {
+							labels[ny][nx] = label
+							stack = append(stack, Point{nx, ny})
+						}
+					}
+				}
+			}
+		}
+	}
+	return labels, sizes
+}
+
+// CropToLargestComponent returns a new PBM image cropped to the bounding box
+// of the largest 8-connected group of set pixels, with every other pixel
+// cleared. It returns an empty image when no pixel is set.
+func (pbm *PBM) CropToLargestComponent() *PBM {
+	labels, sizes := pbm.labelComponents()
+	largest := 0
+	for label := 1; label < len(sizes); label++ {
+		if sizes[label] > sizes[largest] {
+			largest = label
+		}
+	}
+	if largest == 0 {
+		result := NewPBM(0, 0)
+		result.magicNumber = pbm.magicNumber
+		return result
+	}
+
+	minX, minY, maxX, maxY := pbm.width, pbm.height, -1, -1
+	for y := 0; y < pbm.height; y++ {
+		for x := 0; x < pbm.width; x++ {
+			if labels[y][x] == largest {
+				minX, maxX = min(minX, x), max(maxX, x)
+				minY, maxY = min(minY, y), max(maxY, y)
+			}
+		}
+	}
+
+	result := NewPBM(maxX-minX+1, maxY-minY+1)
+	result.magicNumber = pbm.magicNumber
+	for y := minY; y <= maxY; y++ {
+		for x := minX; x <= maxX; x++ {
+			result.data[y-minY][x-minX] = labels[y][x] == largest
+		}
+	}
+	return result
+}
+
+// RLEBytes returns a run-length encoding of the image. Each row is encoded
+// independently as alternating runs of unset and set pixels, starting with
+// an unset run (which is zero-length when the row begins with a set pixel).
+// Every run length is written as an unsigned varint (encoding/binary), and
+// the runs of a row sum to the image width. The dimensions are not stored.
+func (pbm *PBM) RLEBytes() []byte {
+	var out []byte
+	for y := 0; y < pbm.height; y++ {
+		row := pbm.data[y]
+		value := false
+		run := 0
+		for x := 0; x < pbm.width; x++ {
+			if row[x] != value {
+				out = binary.AppendUvarint(out, uint64(run))
+				value, run = row[x], 0
+			}
+			run++
+		}
+		if pbm.width > 0 {
+			out = binary.AppendUvarint(out, uint64(run))
+		}
+	}
+	return out
+}
+
+// NewPBMFromRLE decodes a width x height P4 image from the run-length
+// encoding produced by RLEBytes. The encoding does not carry the magic
+// number; call SetMagicNumber for a P1 image.
+func NewPBMFromRLE(data []byte, width, height int) (*PBM, error) {
+	if width < 0 || height < 0 {
+		return nil, fmt.Errorf("invalid dimensions %dx%d", width, height)
+	}
+	pbm := NewPBM(width, height)
+	pbm.magicNumber = "P4"
+	for y := 0; y < height; y++ {
+		value := false
+		for x := 0; x < width; {
+			run, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, fmt.Errorf("truncated or invalid run at row %d, column %d", y, x)
+			}
+			data = data[n:]
+			if run > uint64(width-x) {
+				return nil, fmt.Errorf("run of %d overflows row %d at column %d", run, y, x)
+			}
+			for end := x + int(run); x < end; x++ {
+				pbm.data[y][x] = value
+			}
+			value = !value
+		}
+	}
+	if len(data) > 0 {
+		return nil, fmt.Errorf("%d unexpected trailing bytes", len(data))
+	}
+	return pbm, nil
+}
+
+// Translate shifts the image by dx pixels right and dy pixels down. With mode
+// "wrap" pixels pushed off one edge reappear on the opposite one; with mode
+// "fill" they are dropped and the uncovered pixels take fill. It returns an
+// error, leaving the image unchanged, for any other mode.
+func (pbm *PBM) Translate(dx, dy int, mode string, fill bool) error {
+	source, err := translation(dx, dy, pbm.width, pbm.height, mode)
+	if err != nil {
+		return err
+	}
+	data := NewPBM(pbm.width, pbm.height).data
+	for y := range data {
+		for x := range data[y] {
+			sx, sy, ok := source(x, y)
+			if !ok {
+				data[y][x] = fill
+				continue
+			}
+			data[y][x] = pbm.data[sy][sx]
+		}
+	}
+	pbm.data = data
+	return nil
+}
@@ -0,0 +1,306 @@
+package Netpbm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// newPBMFrom builds a PBM from rows of '1' (set) and '0' (unset) characters.
+func newPBMFrom(rows ...string) *PBM {
+	pbm := NewPBM(len(rows[0]), len(rows))
+	for y, row := range rows {
+		for x, c := range row {
+			pbm.data[y][x] = c == '1'
+		}
+	}
+	return pbm
+}
+
+func TestToBraille(t *testing.T) {
+	pbm := newPBMFrom(
+		"11",
+		"10",
+		"10",
+		"10",
+	)
+	// Left column: dots 1, 2, 3 and 7; top right: dot 4.
+	if got, want := pbm.ToBraille(), "⡏\n"; got != want {
+		t.Errorf("ToBraille() = %q, want %q", got, want)
+	}
+	if got, want := NewPBM(3, 5).ToBraille(), "⠀⠀\n⠀⠀\n"; got != want {
+		t.Errorf("blank 3x5 ToBraille() = %q, want %q", got, want)
+	}
+}
+
+func TestRender(t *testing.T) {
+	fg, bg := Pixel{200, 10, 30}, Pixel{5, 6, 7}
+	pbm := newPBMFrom(
+		"101",
+		"010",
+	)
+	ppm := pbm.Render(fg, bg)
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			want := bg
+			if pbm.At(x, y) {
+				want = fg
+			}
+			if got := ppm.At(x, y); got != want {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestAtSetNonSquare(t *testing.T) {
+	pbm := NewPBM(3, 5)
+	for i := 0; i < 3; i++ {
+		pbm.Set(i, i, true)
+	}
+	pbm.Set(3, 0, true)
+	pbm.Set(-1, 4, true)
+	pbm.Set(0, 5, true)
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 3; x++ {
+			if got, want := pbm.At(x, y), x == y; got != want {
+				t.Errorf("At(%d, %d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+	if pbm.At(4, 1) || pbm.At(1, -1) {
+		t.Error("At outside the image returned true")
+	}
+}
+
+func TestSizeIsWidthThenHeight(t *testing.T) {
+	pbm, err := ReadPBMFrom(strings.NewReader("P1\n6 2\n1 0 1 0 1 0\n0 1 0 1 0 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := pbm.Size(); w != 6 || h != 2 {
+		t.Errorf("Size() = %d, %d, want 6, 2", w, h)
+	}
+}
+
+func TestCropToLargestComponent(t *testing.T) {
+	pbm := newPBMFrom(
+		"100000000011",
+		"000000000000",
+		"000100000000",
+		"000101000000",
+		"000100000000",
+		"000100000000",
+		"000111110000",
+		"000000000000",
+		"000000000000",
+		"000000000001",
+	)
+	want := newPBMFrom(
+		"10000",
+		"10000",
+		"10000",
+		"10000",
+		"11111",
+	)
+	got := pbm.CropToLargestComponent()
+	if !got.Equal(want) {
+		t.Errorf("CropToLargestComponent() =\n%v\nwant\n%v", got.data, want.data)
+	}
+	if empty := NewPBM(4, 4).CropToLargestComponent(); empty.width != 0 || empty.height != 0 {
+		t.Errorf("blank image cropped to %dx%d, want 0x0", empty.width, empty.height)
+	}
+}
+
+func TestRLERoundTrip(t *testing.T) {
+	pbm := newPBMFrom(
+		"1100101",
+		"0000000",
+		"1111111",
+		"0111110",
+	)
+	decoded, err := NewPBMFromRLE(pbm.RLEBytes(), pbm.width, pbm.height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.magicNumber != "P4" {
+		t.Errorf("decoded magic number = %s, want P4", decoded.magicNumber)
+	}
+	if diff, err := decoded.Diff(pbm); err != nil || diff != 0 {
+		t.Errorf("RLE round trip = %v, want %v", decoded.data, pbm.data)
+	}
+	decoded.SetMagicNumber("P1")
+	if !decoded.Equal(pbm) {
+		t.Errorf("RLE round trip with P1 set = %v, want %v", decoded.data, pbm.data)
+	}
+	if _, err := NewPBMFromRLE([]byte{3}, 7, 1); err == nil {
+		t.Error("NewPBMFromRLE accepted a truncated row")
+	}
+}
+
+func TestRLESmallerThanP4ForSparsePage(t *testing.T) {
+	// A mostly-white page: a few short strokes on 1000x1000.
+	pbm := NewPBM(1000, 1000)
+	pbm.SetMagicNumber("P4")
+	for y := 100; y < 900; y += 50 {
+		for x := 200; x < 260; x++ {
+			pbm.Set(x, y, true)
+		}
+	}
+	var p4 bytes.Buffer
+	if _, err := pbm.WriteTo(&p4); err != nil {
+		t.Fatal(err)
+	}
+	if rle := len(pbm.RLEBytes()); rle >= p4.Len() {
+		t.Errorf("RLE is %d bytes, P4 is %d; want RLE smaller", rle, p4.Len())
+	}
+}
+
+func TestAutoPolarity(t *testing.T) {
+	pbm := newPBMFrom(
+		"1111",
+		"1001",
+		"1111",
+	)
+	if !pbm.AutoPolarity() {
+		t.Fatal("mostly-set image was not inverted")
+	}
+	want := newPBMFrom(
+		"0000",
+		"0110",
+		"0000",
+	)
+	if !pbm.Equal(want) {
+		t.Errorf("AutoPolarity() = %v, want %v", pbm.data, want.data)
+	}
+	if pbm.AutoPolarity() {
+		t.Error("mostly-unset image was inverted")
+	}
+	// 2 of 12 set: above a 10% threshold.
+	if !pbm.AutoPolarityThreshold(0.1) {
+		t.Error("AutoPolarityThreshold(0.1) did not invert a 17% image")
+	}
+}
+
+func TestP4CommentBeforeData(t *testing.T) {
+	// The first data byte is '#' (0x23), which must not be taken for a comment.
+	input := "P4\n# size next\n\n10 # width\n# height next\n2\n# last comment\n\x23\xC0\xFF\x40"
+	pbm, err := ReadPBMFrom(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := newPBMFrom(
+		"0010001111",
+		"1111111101",
+	)
+	want.SetMagicNumber("P4")
+	if !pbm.Equal(want) {
+		t.Errorf("decoded %v, want %v", pbm.data, want.data)
+	}
+}
+
+func TestCheckerboardToPGMAndPPM(t *testing.T) {
+	pbm := newPBMFrom(
+		"1010",
+		"0101",
+		"1010",
+	)
+	on, off := Pixel{200, 0, 50}, Pixel{1, 2, 3}
+	pgm := pbm.ToPGM(15)
+	ppm := pbm.ToPPM(on, off)
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 4; x++ {
+			wantGray, wantColor := uint16(15), off
+			if (x+y)%2 == 0 {
+				wantGray, wantColor = 0, on
+			}
+			if got := pgm.At(x, y); got != wantGray {
+				t.Errorf("PGM pixel (%d,%d) = %d, want %d", x, y, got, wantGray)
+			}
+			if got := ppm.At(x, y); got != wantColor {
+				t.Errorf("PPM pixel (%d,%d) = %v, want %v", x, y, got, wantColor)
+			}
+		}
+	}
+	if pgm.max != 15 {
+		t.Errorf("PGM max = %d, want 15", pgm.max)
+	}
+}
+
+func TestP4RowPaddingRoundTrip(t *testing.T) {
+	for _, width := range []int{5, 11, 13} {
+		pbm := NewPBM(width, 3)
+		pbm.SetMagicNumber("P4")
+		for x := 0; x < width; x++ {
+			pbm.data[0][x] = true
+			pbm.data[1][x] = (x*3)%7 < 3
+			pbm.data[2][x] = x == width-1
+		}
+		var buf bytes.Buffer
+		if _, err := pbm.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		stride := (width + 7) / 8
+		raw := buf.Bytes()
+		pixels := raw[len(raw)-3*stride:]
+		for y := 0; y < 3; y++ {
+			last := pixels[y*stride+stride-1]
+			if pad := last & (0xFF >> (width % 8)); pad != 0 {
+				t.Errorf("width %d row %d: padding bits %08b, want zero", width, y, pad)
+			}
+		}
+		got, err := ReadPBMFrom(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(pbm) {
+			t.Errorf("width %d: decoded %v, want %v", width, got.data, pbm.data)
+		}
+
+		// Padding bits set by another encoder must be ignored on read.
+		for y := 0; y < 3; y++ {
+			pixels[y*stride+stride-1] |= 0xFF >> (width % 8)
+		}
+		got, err = ReadPBMFrom(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(pbm) {
+			t.Errorf("width %d with set padding: decoded %v, want %v", width, got.data, pbm.data)
+		}
+	}
+}
+
+func TestP4RowBoundaries(t *testing.T) {
+	for _, width := range []int{7, 8, 9} {
+		const height = 4
+		want := NewPBM(width, height)
+		want.SetMagicNumber("P4")
+		stride := (width + 7) / 8
+		input := []byte(fmt.Sprintf("P4\n%d %d\n", width, height))
+		for y := 0; y < height; y++ {
+			row := make([]byte, stride)
+			for x := 0; x < width; x++ {
+				if (x+y)%3 == 0 || x == width-1 {
+					want.data[y][x] = true
+					row[x/8] |= 0x80 >> (x % 8)
+				}
+			}
+			input = append(input, row...)
+		}
+
+		got, err := ReadPBMFrom(iotest.OneByteReader(bytes.NewReader(input)))
+		if err != nil {
+			t.Fatalf("width %d: %v", width, err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("width %d: decoded %v, want %v", width, got.data, want.data)
+		}
+
+		if _, err := ReadPBMFrom(bytes.NewReader(input[:len(input)-1])); err == nil {
+			t.Errorf("width %d: truncated data decoded without error", width)
+		}
+	}
+}
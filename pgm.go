@@ -2,113 +2,324 @@ package Netpbm
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"image"
 	"io"
+	"math"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // PGM represents a Portable Graymap image.
 type PGM struct {
-	data          [][]uint8
+	data          [][]uint16
 	width, height int
 	magicNumber   string
-	max           uint8
+	max           uint16
+	comments      []string
+	metadata      map[string]string
+}
+
+// NewPGM creates a black P2 PGM image of the given size and max value.
+func NewPGM(width, height int, max uint16) *PGM {
+	pgm := &PGM{
+		data:        make([][]uint16, height),
+		width:       width,
+		height:      height,
+		magicNumber: "P2",
+		max:         max,
+	}
+	for y := range pgm.data {
+		pgm.data[y] = make([]uint16, width)
+	}
+	return pgm
 }
 
 // ReadPGM reads a PGM file and returns a PGM struct.
 func ReadPGM(filename string) (*PGM, error) {
+	return ReadPGMWithOptions(filename, ReadOptions{})
+}
+
+// ReadPGMWithOptions reads a PGM file using the given options.
+func ReadPGMWithOptions(filename string, opts ReadOptions) (*PGM, error) {
+	start := time.Now()
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	return readPGM(file, opts, start)
+}
+
+// ReadPGMFrom reads a PGM image from r, such as an HTTP body or an in-memory buffer.
+func ReadPGMFrom(r io.Reader) (*PGM, error) {
+	return readPGM(r, ReadOptions{}, time.Now())
+}
 
+// ReadPGMPreview reads a low-resolution preview of a binary P5 file without
+// decoding it at full resolution. It keeps every Nth pixel of every Nth row,
+// where N is the smallest step that brings both dimensions down to at most
+// maxDim, and skips the other rows unparsed. The result matches a
+// nearest-neighbor downscale that samples the top-left pixel of each block.
+func ReadPGMPreview(filename string, maxDim int) (*PGM, error) {
+	if maxDim < 1 {
+		return nil, fmt.Errorf("invalid preview size: %d", maxDim)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 	reader := bufio.NewReader(file)
 
+	var comments []string
+	magicNumber, err := readHeaderToken(reader, &comments)
+	if err != nil {
+		return nil, fmt.Errorf("error reading magic number: %v", err)
+	}
+	if magicNumber != "P5" {
+		return nil, fmt.Errorf("preview requires a binary P5 image, got %s", magicNumber)
+	}
+	width, height, err := readDimensions(reader, &comments)
+	if err != nil {
+		return nil, fmt.Errorf("error reading dimensions: %v", err)
+	}
+	maxValue, err := readMaxValue(reader, &comments)
+	if err != nil {
+		return nil, fmt.Errorf("error reading max value: %v", err)
+	}
+
+	step := (max(width, height) + maxDim - 1) / maxDim
+	step = max(step, 1)
+	pgm := NewPGM((width+step-1)/step, (height+step-1)/step, maxValue)
+	pgm.magicNumber = magicNumber
+	pgm.comments, pgm.metadata = splitMetadata(comments)
+
+	size := bytesPerSample(maxValue)
+	row := make([]byte, width*size)
+	for y := 0; y < height; y++ {
+		if y%step != 0 {
+			if _, err := reader.Discard(len(row)); err != nil {
+				return nil, fmt.Errorf("error skipping row %d: %v", y, err)
+			}
+			continue
+		}
+		if _, err := io.ReadFull(reader, row); err != nil {
+			return nil, fmt.Errorf("error reading pixel data at row %d: %v", y, err)
+		}
+		out := pgm.data[y/step]
+		for x := range out {
+			out[x] = getSample(row, x*step, size)
+		}
+	}
+	return pgm, nil
+}
+
+// readPGM parses a PGM image from r. start is when the read began, for DecodeStats.
+func readPGM(r io.Reader, opts ReadOptions, start time.Time) (*PGM, error) {
+	counter := &countingReader{reader: r}
+	rows := 0
+	defer func() { opts.Stats.record(counter.n, rows, start) }()
+	reader := bufio.NewReader(counter)
+
 	//Magic number
-	magicNumber, err := readString(reader)
+	var comments []string
+	magicNumber, err := readHeaderToken(reader, &comments)
 	if err != nil {
 		return nil, fmt.Errorf("error reading magic number: %v", err)
 	}
-	magicNumber = strings.TrimSpace(magicNumber)
 	if magicNumber != "P2" && magicNumber != "P5" {
 		return nil, fmt.Errorf("invalid magic number: %s", magicNumber)
 	}
 
 	//Size
-	width, height, err := readDimensions(reader)
+	width, height, err := readDimensions(reader, &comments)
 	if err != nil {
 		return nil, fmt.Errorf("error reading dimensions: %v", err)
 	}
 
 	//Max value
-	max, err := readMaxValue(reader)
+	max, reader, err := readHeaderMaxValue(reader, magicNumber == "P5", width*height, opts, &comments)
 	if err != nil {
 		return nil, fmt.Errorf("error reading max value: %v", err)
 	}
 
-	data, err := readImageData(reader, magicNumber, width, height)
+	data, err := readImageData(reader, magicNumber, width, height, max)
 	if err != nil {
 		return nil, err
 	}
+	rows = len(data)
 
-	return &PGM{data, width, height, magicNumber, max}, nil
+	pgm := &PGM{data: data, width: width, height: height, magicNumber: magicNumber, max: max}
+	pgm.comments, pgm.metadata = splitMetadata(comments)
+	return pgm, nil
 }
 
-func readString(reader *bufio.Reader) (string, error) {
-	str, err := reader.ReadString('\n')
-	return strings.TrimSpace(str), err
+// readToken returns the next whitespace-delimited token, regardless of line
+// breaks, and consumes the single whitespace character that ends it.
+// Comments run from '#' to the end of the line and are skipped, including
+// one that directly follows a token on the same line.
+func readToken(reader *bufio.Reader) (string, error) {
+	return readHeaderToken(reader, nil)
 }
 
-func readDimensions(reader *bufio.Reader) (int, int, error) {
-	dimensions, err := readString(reader)
-	if err != nil {
-		return 0, 0, fmt.Errorf("error reading dimensions: %v", err)
+// readHeaderToken is readToken that also appends the text of every skipped
+// comment to comments, when it is not nil.
+func readHeaderToken(reader *bufio.Reader, comments *[]string) (string, error) {
+	var token []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(token) > 0 {
+				return string(token), nil
+			}
+			return "", err
+		}
+		if b == '#' {
+			comment, err := readComment(reader)
+			if comments != nil {
+				*comments = append(*comments, comment)
+			}
+			if len(token) > 0 {
+				return string(token), nil
+			}
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		if isSpace(b) {
+			if len(token) > 0 {
+				return string(token), nil
+			}
+			continue
+		}
+		token = append(token, b)
 	}
-	var width, height int
-	_, err = fmt.Sscanf(strings.TrimSpace(dimensions), "%d %d", &width, &height)
-	if err != nil {
-		return 0, 0, fmt.Errorf("invalid dimensions: %v", err)
+}
+
+// readComment consumes the rest of a comment line, including its line break,
+// and returns its text without surrounding whitespace. A comment ended by the
+// end of the input is returned along with io.EOF.
+func readComment(reader *bufio.Reader) (string, error) {
+	var text []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return strings.TrimSpace(string(text)), err
+		}
+		if b == '\n' || b == '\r' {
+			return strings.TrimSpace(string(text)), nil
+		}
+		text = append(text, b)
+	}
+}
+
+// isSpace reports whether b is a Netpbm whitespace character.
+func isSpace(b byte) bool {
+	switch b {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
 	}
+	return false
+}
+
+func readDimensions(reader *bufio.Reader, comments *[]string) (int, int, error) {
+	var dimensions [2]int
+	for i := range dimensions {
+		token, err := readHeaderToken(reader, comments)
+		if err != nil {
+			return 0, 0, fmt.Errorf("error reading dimensions: %v", err)
+		}
+		dimensions[i], err = strconv.Atoi(token)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid dimensions: %v", err)
+		}
+	}
+	width, height := dimensions[0], dimensions[1]
 	if width <= 0 || height <= 0 {
 		return 0, 0, fmt.Errorf("invalid dimensions: width and height must be positive")
 	}
 	return width, height, nil
 }
 
-func readMaxValue(reader *bufio.Reader) (uint8, error) {
-	maxValue, err := readString(reader)
+func readMaxValue(reader *bufio.Reader, comments *[]string) (uint16, error) {
+	maxValue, err := readHeaderToken(reader, comments)
 	if err != nil {
 		return 0, fmt.Errorf("error reading max value: %v", err)
 	}
-	maxValue = strings.TrimSpace(maxValue)
-	var max uint8
+	var max uint16
 	_, err = fmt.Sscanf(maxValue, "%d", &max)
 	if err != nil {
 		return 0, fmt.Errorf("invalid max value: %v", err)
 	}
+	if max == 0 {
+		return 0, fmt.Errorf("invalid max value: must be between 1 and 65535")
+	}
 	return max, nil
 }
 
-func readImageData(reader *bufio.Reader, magicNumber string, width, height int) ([][]uint8, error) {
-	data := make([][]uint8, height)
-	expectedBytesPerPixel := 1
+// readHeaderMaxValue reads the max value, honoring opts.AssumeMaxVal255 for
+// images of the given number of samples, and collects comments like
+// readHeaderToken. It returns the reader to continue decoding the pixel data
+// from.
+func readHeaderMaxValue(reader *bufio.Reader, binary bool, samples int, opts ReadOptions, comments *[]string) (uint16, *bufio.Reader, error) {
+	if !opts.AssumeMaxVal255 {
+		max, err := readMaxValue(reader, comments)
+		return max, reader, err
+	}
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !missingMaxValue(rest, binary, samples) {
+		reader = bufio.NewReader(bytes.NewReader(rest))
+		var found []string
+		max, err := readMaxValue(reader, &found)
+		if err == nil {
+			if comments != nil {
+				*comments = append(*comments, found...)
+			}
+			return max, reader, nil
+		}
+	}
+	return 255, bufio.NewReader(bytes.NewReader(rest)), nil
+}
+
+// missingMaxValue reports whether rest, the bytes after the dimensions, holds
+// exactly the pixel data of an 8-bit image with no max value before it.
+func missingMaxValue(rest []byte, binary bool, samples int) bool {
+	if binary {
+		return len(rest) == samples
+	}
+	reader := bufio.NewReader(bytes.NewReader(rest))
+	tokens := 0
+	for {
+		_, err := readToken(reader)
+		if err != nil {
+			return tokens == samples
+		}
+		tokens++
+	}
+}
+
+func readImageData(reader *bufio.Reader, magicNumber string, width, height int, max uint16) ([][]uint16, error) {
+	data := make([][]uint16, height)
+	expectedBytesPerPixel := bytesPerSample(max)
 
 	if magicNumber == "P2" {
 		for y := 0; y < height; y++ {
-			line, err := readString(reader)
-			if err != nil {
-				return nil, fmt.Errorf("error reading data at row %d: %v", y, err)
-			}
-			fields := strings.Fields(line)
-			rowData := make([]uint8, width)
-			for x, field := range fields {
-				if x >= width {
-					return nil, fmt.Errorf("index out of range at row %d", y)
+			rowData := make([]uint16, width)
+			for x := 0; x < width; x++ {
+				field, err := readToken(reader)
+				if err != nil {
+					return nil, fmt.Errorf("error reading data at row %d, column %d: %v", y, x, err)
 				}
-				var pixelValue uint8
-				_, err := fmt.Sscanf(field, "%d", &pixelValue)
+				var pixelValue uint16
+				_, err = fmt.Sscanf(field, "%d", &pixelValue)
 				if err != nil {
 					return nil, fmt.Errorf("error parsing pixel value at row %d, column %d: %v", y, x, err)
 				}
@@ -119,21 +330,22 @@ func readImageData(reader *bufio.Reader, magicNumber string, width, height int)
 	} else if magicNumber == "P5" {
 		for y := 0; y < height; y++ {
 			row := make([]byte, width*expectedBytesPerPixel)
-			n, err := reader.Read(row)
+			// io.ReadFull retries the short reads a bufio.Reader may return
+			// before the underlying stream is exhausted.
+			n, err := io.ReadFull(reader, row)
+			if err == io.EOF {
+				return nil, fmt.Errorf("unexpected end of file at row %d", y)
+			}
+			if err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("unexpected end of file at row %d, expected %d bytes, got %d", y, len(row), n)
+			}
 			if err != nil {
-				if err == io.EOF {
-					return nil, fmt.Errorf("unexpected end of file at row %d", y)
-				}
 				return nil, fmt.Errorf("error reading pixel data at row %d: %v", y, err)
 			}
-			if n < width*expectedBytesPerPixel {
-				return nil, fmt.Errorf("unexpected end of file at row %d, expected %d bytes, got %d", y, width*expectedBytesPerPixel, n)
-			}
 
-			rowData := make([]uint8, width)
+			rowData := make([]uint16, width)
 			for x := 0; x < width; x++ {
-				pixelValue := uint8(row[x*expectedBytesPerPixel])
-				rowData[x] = pixelValue
+				rowData[x] = getSample(row, x, expectedBytesPerPixel)
 			}
 			data[y] = rowData
 		}
@@ -147,7 +359,7 @@ func (pgm *PGM) Size() (int, int) {
 }
 
 // At returns the pixel value at the specified coordinates.
-func (pgm *PGM) At(x, y int) uint8 {
+func (pgm *PGM) At(x, y int) uint16 {
 	if x >= 0 && x < pgm.width && y >= 0 && y < pgm.height {
 		return pgm.data[y][x]
 	}
@@ -155,7 +367,7 @@ func (pgm *PGM) At(x, y int) uint8 {
 }
 
 // Set updates the pixel value at the specified coordinates.
-func (pgm *PGM) Set(x, y int, value uint8) {
+func (pgm *PGM) Set(x, y int, value uint16) {
 	if x >= 0 && x < pgm.width && y >= 0 && y < pgm.height {
 		pgm.data[y][x] = value
 	}
@@ -163,17 +375,42 @@ func (pgm *PGM) Set(x, y int, value uint8) {
 
 // Save saves the PGM image to a file in the opposite format (P2 or P5) and returns an error if there was a problem.
 func (pgm *PGM) Save(filename string) error {
+	return pgm.SaveWithOptions(filename, SaveOptions{})
+}
+
+// SaveWithOptions saves the PGM image to a file using the given options.
+func (pgm *PGM) SaveWithOptions(filename string, opts SaveOptions) error {
 	file, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
+	_, err = pgm.writeTo(file, opts)
+	return err
+}
+
+// WriteTo writes the PGM image to w in its current format and returns the
+// number of bytes written. It implements io.WriterTo.
+func (pgm *PGM) WriteTo(w io.Writer) (int64, error) {
+	return pgm.writeTo(w, SaveOptions{})
+}
 
-	writer := bufio.NewWriter(file)
-	_, err = fmt.Fprintln(writer, pgm.magicNumber)
+func (pgm *PGM) writeTo(w io.Writer, opts SaveOptions) (int64, error) {
+	return writeBuffered(w, func(writer *bufio.Writer) error {
+		return pgm.encode(writer, opts)
+	})
+}
+
+// encode writes the header and pixel data to writer.
+func (pgm *PGM) encode(writer *bufio.Writer, opts SaveOptions) error {
+	_, err := fmt.Fprintln(writer, pgm.magicNumber)
 	if err != nil {
 		return fmt.Errorf("error writing magic number: %v", err)
 	}
+	err = writeComments(writer, pgm.comments, pgm.metadata, opts)
+	if err != nil {
+		return err
+	}
 	_, err = fmt.Fprintf(writer, "%d %d\n", pgm.width, pgm.height)
 	if err != nil {
 		return fmt.Errorf("error writing dimensions: %v", err)
@@ -188,7 +425,7 @@ func (pgm *PGM) Save(filename string) error {
 		}
 	}
 	if pgm.magicNumber == "P2" {
-		err = pgm.saveP2PGM(writer)
+		err = pgm.saveP2PGM(writer, opts)
 		if err != nil {
 			return err
 		}
@@ -198,14 +435,14 @@ func (pgm *PGM) Save(filename string) error {
 			return err
 		}
 	}
-
-	return writer.Flush()
+	return nil
 }
 
-func (pgm *PGM) saveP2PGM(file *bufio.Writer) error {
+func (pgm *PGM) saveP2PGM(file *bufio.Writer, opts SaveOptions) error {
+	format := sampleFormat(pgm.max, opts)
 	for y := 0; y < pgm.height; y++ {
 		for x := 0; x < pgm.width; x++ {
-			_, err := fmt.Fprint(file, pgm.data[y][x])
+			_, err := fmt.Fprintf(file, format, pgm.data[y][x])
 			if err != nil {
 				return fmt.Errorf("error writing pixel data at row %d, column %d: %v", y, x, err)
 			}
@@ -226,15 +463,15 @@ func (pgm *PGM) saveP2PGM(file *bufio.Writer) error {
 }
 
 func (pgm *PGM) saveP5PGM(file *bufio.Writer) error {
-	for y := 0; y < pgm.height; y++ {
-		row := make([]byte, pgm.width)
+	size := bytesPerSample(pgm.max)
+	payload := packRows(pgm.height, pgm.width*size, func(y int, row []byte) {
 		for x := 0; x < pgm.width; x++ {
-			row[x] = byte(pgm.data[y][x])
-		}
-		_, err := file.Write(row)
-		if err != nil {
-			return fmt.Errorf("error writing pixel data at row %d: %v", y, err)
+			putSample(row, x, size, pgm.data[y][x])
 		}
+	})
+	_, err := file.Write(payload)
+	if err != nil {
+		return fmt.Errorf("error writing pixel data: %v", err)
 	}
 	return nil
 }
@@ -243,7 +480,7 @@ func (pgm *PGM) saveP5PGM(file *bufio.Writer) error {
 func (pgm *PGM) Invert() {
 	for i := range pgm.data {
 		for j := range pgm.data[i] {
-			pgm.data[i][j] = uint8(pgm.max) - pgm.data[i][j]
+			pgm.data[i][j] = uint16(pgm.max) - pgm.data[i][j]
 		}
 	}
 }
@@ -269,18 +506,82 @@ func (pgm *PGM) SetMagicNumber(magicNumber string) {
 	pgm.magicNumber = magicNumber
 }
 
-// SetMaxValue sets the maximum pixel value of the PGM image.
-func (pgm *PGM) SetMaxValue(maxValue uint8) {
+// AddComment adds a comment line written to the header on Save.
+func (pgm *PGM) AddComment(comment string) {
+	pgm.comments = append(pgm.comments, comment)
+}
+
+// SetMetadata stores a key/value pair that is written to the header as a
+// "# key: value" comment and read back into the metadata on load. Keys are a
+// single word of letters, digits, '-', '_' or '.'; values must fit on one
+// line.
+func (pgm *PGM) SetMetadata(key, value string) error {
+	return setMetadata(&pgm.metadata, key, value)
+}
+
+// GetMetadata returns the metadata value stored under key.
+func (pgm *PGM) GetMetadata(key string) (string, bool) {
+	value, ok := pgm.metadata[key]
+	return value, ok
+}
+
+// SetResolution records the physical resolution in dots per inch, stored as
+// "dpi" metadata since Netpbm has no native field for it.
+func (pgm *PGM) SetResolution(dpiX, dpiY float64) error {
+	return setResolution(&pgm.metadata, dpiX, dpiY)
+}
+
+// Resolution returns the horizontal and vertical resolution in dots per inch,
+// or zeros when none is recorded.
+func (pgm *PGM) Resolution() (float64, float64) {
+	return resolution(pgm.metadata)
+}
+
+// PhysicalSize returns the printed width and height in inches, or zeros when
+// no resolution is recorded.
+func (pgm *PGM) PhysicalSize() (float64, float64) {
+	return physicalSize(pgm.width, pgm.height, pgm.metadata)
+}
+
+// SetMaxValue sets the maximum pixel value of the PGM image, rescaling every
+// sample to the new range with rounding. A max value of 0 is rejected and
+// leaves the image unchanged.
+func (pgm *PGM) SetMaxValue(maxValue uint16) {
+	if maxValue == 0 {
+		return
+	}
 	for y := 0; y < pgm.height; y++ {
 		for x := 0; x < pgm.width; x++ {
+			pgm.data[y][x] = rescaleSample(pgm.data[y][x], pgm.max, maxValue)
+		}
+	}
 
-			scaledValue := float64(pgm.data[y][x]) * float64(maxValue) / float64(pgm.max)
+	pgm.max = maxValue
+}
 
-			newValue := uint8(scaledValue)
-			pgm.data[y][x] = newValue
+// SetMaxValueDithered rescales the image to a new max value like SetMaxValue,
+// but rounds with Floyd-Steinberg error diffusion so that reducing the bit
+// depth (for example from 16 to 8 bits) trades contour banding for fine
+// noise. A max value of 0 is rejected and leaves the image unchanged.
+func (pgm *PGM) SetMaxValueDithered(maxValue uint16) {
+	if maxValue == 0 || pgm.max == 0 {
+		return
+	}
+	values := pgm.floatData()
+	scale := float64(maxValue) / float64(pgm.max)
+	for y := range values {
+		for x := range values[y] {
+			values[y][x] *= scale
+		}
+	}
+	floydSteinberg(values, func(v float64) float64 {
+		return math.Round(math.Max(0, math.Min(v, float64(maxValue))))
+	})
+	for y := range values {
+		for x := range values[y] {
+			pgm.data[y][x] = uint16(values[y][x])
 		}
 	}
-
 	pgm.max = maxValue
 }
 
@@ -290,9 +591,9 @@ func (pgm *PGM) Rotate90CW() {
 		return
 	}
 
-	newData := make([][]uint8, pgm.width)
+	newData := make([][]uint16, pgm.width)
 	for i := 0; i < pgm.width; i++ {
-		newData[i] = make([]uint8, pgm.height)
+		newData[i] = make([]uint16, pgm.height)
 		for j := 0; j < pgm.height; j++ {
 			newData[i][j] = pgm.data[pgm.height-j-1][i]
 		}
@@ -301,18 +602,98 @@ func (pgm *PGM) Rotate90CW() {
 	pgm.width, pgm.height = pgm.height, pgm.width
 }
 
-// ToPBM converts the PGM image to a PBM image.
-func (pgm *PGM) ToPBM() *PBM {
-	pbm := &PBM{
-		data:        make([][]bool, pgm.height),
-		width:       pgm.width,
-		height:      pgm.height,
-		magicNumber: "P1",
+// Rotate90CCW rotates the PGM image 90 degrees counterclockwise.
+func (pgm *PGM) Rotate90CCW() {
+	if pgm.width <= 0 || pgm.height <= 0 {
+		return
+	}
+
+	newData := make([][]uint16, pgm.width)
+	for i := 0; i < pgm.width; i++ {
+		newData[pgm.width-1-i] = make([]uint16, pgm.height)
+		for j := 0; j < pgm.height; j++ {
+			newData[pgm.width-1-i][j] = pgm.data[j][i]
+		}
+	}
+	pgm.data = newData
+	pgm.width, pgm.height = pgm.height, pgm.width
+}
+
+// Rotate270CW rotates the PGM image 270 degrees clockwise. It is the same as
+// Rotate90CCW.
+func (pgm *PGM) Rotate270CW() {
+	pgm.Rotate90CCW()
+}
+
+// Rotate180 rotates the PGM image 180 degrees in place.
+func (pgm *PGM) Rotate180() {
+	pgm.Flip()
+	pgm.Flop()
+}
+
+// Rotate rotates the image clockwise by angle degrees about its center. The
+// image grows to contain the rotated bounds; each pixel takes the nearest
+// source pixel, and pixels with no source are filled with bg.
+func (pgm *PGM) Rotate(angle float64, bg uint16) {
+	pgm.RotateInterpolated(angle, bg, NearestNeighbor)
+}
+
+// RotateInterpolated is Rotate with a choice of interpolation. A pixel is
+// filled with bg when its source position lies outside the image. Exact
+// multiples of 90 degrees use the lossless quarter-turn rotations instead.
+func (pgm *PGM) RotateInterpolated(angle float64, bg uint16, interp Interpolation) {
+	if turns, ok := quarterTurns(angle); ok {
+		// Exact quarter turns need no resampling.
+		switch turns {
+		case 1:
+			pgm.Rotate90CW()
+		case 2:
+			pgm.Rotate180()
+		case 3:
+			pgm.Rotate270CW()
+		}
+		return
+	}
+	pgm.rotateResampled(angle, bg, interp)
+}
+
+// rotateResampled is the general path of RotateInterpolated: each output
+// pixel is mapped back to its source position and interpolated there.
+func (pgm *PGM) rotateResampled(angle float64, bg uint16, interp Interpolation) {
+	newWidth, newHeight, source := rotation(pgm.width, pgm.height, angle)
+	sample := func(x, y int) float64 { return float64(pgm.data[y][x]) }
+	data := make([][]uint16, newHeight)
+	for y := range data {
+		data[y] = make([]uint16, newWidth)
+		for x := range data[y] {
+			fx, fy := source(x, y)
+			sx, sy := int(math.Round(fx)), int(math.Round(fy))
+			if sx < 0 || sx >= pgm.width || sy < 0 || sy >= pgm.height {
+				data[y][x] = bg
+				continue
+			}
+			v := interpolate(fx, fy, pgm.width, pgm.height, interp, sample)
+			data[y][x] = uint16(math.Round(math.Max(0, math.Min(v, float64(pgm.max)))))
+		}
 	}
+	pgm.data = data
+	pgm.width, pgm.height = newWidth, newHeight
+}
+
+// ToPBM converts the PGM image to a PBM image at the midpoint threshold; it
+// is ToPBMThreshold(128).
+func (pgm *PGM) ToPBM() *PBM {
+	return pgm.ToPBMThreshold(128)
+}
+
+// ToPBMThreshold converts the PGM image to a PBM image. A pixel is set
+// (black) where its sample, scaled to 0-255, is below threshold, so a
+// threshold of 0 gives an all-white image.
+func (pgm *PGM) ToPBMThreshold(threshold uint8) *PBM {
+	pbm := NewPBM(pgm.width, pgm.height)
 	for y := 0; y < pgm.height; y++ {
-		pbm.data[y] = make([]bool, pgm.width)
 		for x := 0; x < pgm.width; x++ {
-			pbm.data[y][x] = pgm.data[y][x] < uint8(pgm.max/2)
+			pbm.data[y][x] = scaleTo8(pgm.data[y][x], pgm.max) < threshold
 		}
 	}
 	return pbm
@@ -327,3 +708,1084 @@ func (pgm *PGM) PrintData() {
 		fmt.Println()
 	}
 }
+
+// ForEachNeighborhood calls fn for every pixel with the (2*radius+1)x(2*radius+1)
+// window centered on it. Coordinates falling outside the image are clamped to
+// the nearest edge, so the window always has the full size.
+// The window is reused between calls and must not be retained by fn.
+func (pgm *PGM) ForEachNeighborhood(radius int, fn func(x, y int, window [][]uint16)) {
+	if radius < 0 {
+		radius = 0
+	}
+	size := 2*radius + 1
+	window := make([][]uint16, size)
+	for i := range window {
+		window[i] = make([]uint16, size)
+	}
+	for y := 0; y < pgm.height; y++ {
+		for x := 0; x < pgm.width; x++ {
+			for dy := -radius; dy <= radius; dy++ {
+				sy := clamp(y+dy, 0, pgm.height-1)
+				for dx := -radius; dx <= radius; dx++ {
+					sx := clamp(x+dx, 0, pgm.width-1)
+					window[dy+radius][dx+radius] = pgm.data[sy][sx]
+				}
+			}
+			fn(x, y, window)
+		}
+	}
+}
+
+// clamp bounds v to [low, high].
+func clamp(v, low, high int) int {
+	if v < low {
+		return low
+	}
+	if v > high {
+		return high
+	}
+	return v
+}
+
+// MaxFilter replaces each pixel with the maximum of its neighborhood (grayscale dilation).
+func (pgm *PGM) MaxFilter(radius int) {
+	pgm.rankFilter(radius, func(a, b uint16) bool { return a > b })
+}
+
+// MinFilter replaces each pixel with the minimum of its neighborhood (grayscale erosion).
+func (pgm *PGM) MinFilter(radius int) {
+	pgm.rankFilter(radius, func(a, b uint16) bool { return a < b })
+}
+
+// rankFilter replaces each pixel with the neighborhood value preferred by better.
+func (pgm *PGM) rankFilter(radius int, better func(a, b uint16) bool) {
+	newData := make([][]uint16, pgm.height)
+	for y := range newData {
+		newData[y] = make([]uint16, pgm.width)
+	}
+	pgm.ForEachNeighborhood(radius, func(x, y int, window [][]uint16) {
+		best := window[0][0]
+		for _, row := range window {
+			for _, value := range row {
+				if better(value, best) {
+					best = value
+				}
+			}
+		}
+		newData[y][x] = best
+	})
+	pgm.data = newData
+}
+
+// MedianFilter replaces each pixel with the median of its (2*radius+1)^2
+// neighborhood, clamped at the borders. It removes salt-and-pepper noise
+// while keeping edges sharp.
+func (pgm *PGM) MedianFilter(radius int) {
+	if radius <= 0 {
+		return
+	}
+	newData := make([][]uint16, pgm.height)
+	for y := range newData {
+		newData[y] = make([]uint16, pgm.width)
+	}
+	values := make([]uint16, 0, (2*radius+1)*(2*radius+1))
+	pgm.ForEachNeighborhood(radius, func(x, y int, window [][]uint16) {
+		values = values[:0]
+		for _, row := range window {
+			values = append(values, row...)
+		}
+		newData[y][x] = median(values)
+	})
+	pgm.data = newData
+}
+
+// median returns the median of values with quickselect, reordering values in
+// the process. values must have an odd, non-zero length.
+func median(values []uint16) uint16 {
+	k := len(values) / 2
+	low, high := 0, len(values)-1
+	for low < high {
+		pivot := values[(low+high)/2]
+		i, j := low, high
+		for i <= j {
+			for values[i] < pivot {
+				i++
+			}
+			for values[j] > pivot {
+				j--
+			}
+			if i <= j {
+				values[i], values[j] = values[j], values[i]
+				i++
+				j--
+			}
+		}
+		switch {
+		case k <= j:
+			high = j
+		case k >= i:
+			low = i
+		default:
+			return values[k]
+		}
+	}
+	return values[k]
+}
+
+// BilateralFilter smooths the image while preserving edges. Each neighbor is
+// weighted by its spatial distance (spatialSigma) and by its intensity
+// difference to the center pixel (rangeSigma). The window extends to 3*spatialSigma.
+func (pgm *PGM) BilateralFilter(spatialSigma, rangeSigma float64) {
+	if spatialSigma <= 0 || rangeSigma <= 0 {
+		return
+	}
+	radius, spatial := bilateralKernel(spatialSigma)
+	newData := make([][]uint16, pgm.height)
+	for y := 0; y < pgm.height; y++ {
+		newData[y] = make([]uint16, pgm.width)
+		for x := 0; x < pgm.width; x++ {
+			center := float64(pgm.data[y][x])
+			var sum, weights float64
+			for dy := -radius; dy <= radius; dy++ {
+				ny := y + dy
+				if ny < 0 || ny >= pgm.height {
+					continue
+				}
+				for dx := -radius; dx <= radius; dx++ {
+					nx := x + dx
+					if nx < 0 || nx >= pgm.width {
+						continue
+					}
+					value := float64(pgm.data[ny][nx])
+					diff := value - center
+					weight := spatial[dy+radius][dx+radius] * math.Exp(-diff*diff/(2*rangeSigma*rangeSigma))
+					sum += weight * value
+					weights += weight
+				}
+			}
+			newData[y][x] = uint16(math.Round(sum / weights))
+		}
+	}
+	pgm.data = newData
+}
+
+// bilateralKernel returns the window radius and the spatial Gaussian weights for sigma.
+func bilateralKernel(sigma float64) (int, [][]float64) {
+	radius := int(math.Ceil(3 * sigma))
+	size := 2*radius + 1
+	kernel := make([][]float64, size)
+	for dy := -radius; dy <= radius; dy++ {
+		kernel[dy+radius] = make([]float64, size)
+		for dx := -radius; dx <= radius; dx++ {
+			kernel[dy+radius][dx+radius] = math.Exp(-float64(dx*dx+dy*dy) / (2 * sigma * sigma))
+		}
+	}
+	return radius, kernel
+}
+
+// Heatmap returns a color visualization of the PGM image. Intensities are
+// normalized from the darkest to the brightest value present, then mapped
+// through a blue -> green -> red colormap.
+func (pgm *PGM) Heatmap() *PPM {
+	ppm := &PPM{
+		data:        make([][]Pixel, pgm.height),
+		width:       pgm.width,
+		height:      pgm.height,
+		magicNumber: "P3",
+		max:         255,
+	}
+
+	low, high := uint16(math.MaxUint16), uint16(0)
+	for _, row := range pgm.data {
+		for _, value := range row {
+			if value < low {
+				low = value
+			}
+			if value > high {
+				high = value
+			}
+		}
+	}
+
+	blue, green, red := Pixel{B: 255}, Pixel{G: 255}, Pixel{R: 255}
+	for y := 0; y < pgm.height; y++ {
+		ppm.data[y] = make([]Pixel, pgm.width)
+		for x := 0; x < pgm.width; x++ {
+			t := 0.0
+			if high > low {
+				t = float64(pgm.data[y][x]-low) / float64(high-low)
+			}
+			if t < 0.5 {
+				ppm.data[y][x] = intColors(blue, green, t*2)
+			} else {
+				ppm.data[y][x] = intColors(green, red, (t-0.5)*2)
+			}
+		}
+	}
+	return ppm
+}
+
+// ClearRect fills the rectangle r with a single value, clipped to the image bounds.
+func (pgm *PGM) ClearRect(r image.Rectangle, value uint16) {
+	r = r.Intersect(image.Rect(0, 0, pgm.width, pgm.height))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			pgm.data[y][x] = value
+		}
+	}
+}
+
+// Crop replaces the image with the sub-rectangle [x, x+w) x [y, y+h). It
+// returns an error, leaving the image unchanged, if the rectangle is empty or
+// extends outside the image.
+func (pgm *PGM) Crop(x, y, w, h int) error {
+	err := checkCrop(x, y, w, h, pgm.width, pgm.height)
+	if err != nil {
+		return err
+	}
+	data := make([][]uint16, h)
+	for row := range data {
+		data[row] = make([]uint16, w)
+		copy(data[row], pgm.data[y+row][x:x+w])
+	}
+	pgm.data = data
+	pgm.width, pgm.height = w, h
+	return nil
+}
+
+// Clone returns a deep copy of the image that shares no memory with it.
+func (pgm *PGM) Clone() *PGM {
+	clone := &PGM{
+		data:        make([][]uint16, len(pgm.data)),
+		width:       pgm.width,
+		height:      pgm.height,
+		magicNumber: pgm.magicNumber,
+		max:         pgm.max,
+		comments:    append([]string(nil), pgm.comments...),
+		metadata:    copyMetadata(pgm.metadata),
+	}
+	for y, row := range pgm.data {
+		clone.data[y] = append([]uint16(nil), row...)
+	}
+	return clone
+}
+
+// Equal reports whether other has the same dimensions, magic number, max value
+// and pixels. Comments are not compared.
+func (pgm *PGM) Equal(other *PGM) bool {
+	if other == nil || pgm.magicNumber != other.magicNumber || pgm.max != other.max {
+		return false
+	}
+	diff, err := pgm.Diff(other)
+	return err == nil && diff == 0
+}
+
+// Diff returns the number of pixels that differ between the image and other.
+// It returns an error if the dimensions do not match.
+func (pgm *PGM) Diff(other *PGM) (int, error) {
+	if other == nil || pgm.width != other.width || pgm.height != other.height {
+		return 0, fmt.Errorf("cannot diff images of different dimensions")
+	}
+	count := 0
+	for y := 0; y < pgm.height; y++ {
+		for x := 0; x < pgm.width; x++ {
+			if pgm.data[y][x] != other.data[y][x] {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// DoG computes the difference of two Gaussian blurs (sigma1 minus sigma2), a
+// band-pass filter that highlights blobs and edges. The response is scaled so
+// the strongest one spans the full range, with zero mapped to mid-gray.
+func (pgm *PGM) DoG(sigma1, sigma2 float64) {
+	if sigma1 <= 0 || sigma2 <= 0 {
+		return
+	}
+	values := pgm.floatData()
+	blur1 := convolveSeparable(values, gaussianKernel(int(math.Ceil(3*sigma1)), sigma1))
+	blur2 := convolveSeparable(values, gaussianKernel(int(math.Ceil(3*sigma2)), sigma2))
+
+	maxAbs := 0.0
+	for y := range blur1 {
+		for x := range blur1[y] {
+			blur1[y][x] -= blur2[y][x]
+			maxAbs = math.Max(maxAbs, math.Abs(blur1[y][x]))
+		}
+	}
+
+	mid := float64(pgm.max) / 2
+	for y := 0; y < pgm.height; y++ {
+		for x := 0; x < pgm.width; x++ {
+			value := mid
+			if maxAbs > 0 {
+				value += blur1[y][x] * mid / maxAbs
+			}
+			pgm.data[y][x] = uint16(math.Max(0, math.Min(math.Round(value), float64(pgm.max))))
+		}
+	}
+}
+
+// floatData returns a copy of the pixel values as float64.
+func (pgm *PGM) floatData() [][]float64 {
+	values := make([][]float64, pgm.height)
+	for y := 0; y < pgm.height; y++ {
+		values[y] = make([]float64, pgm.width)
+		for x := 0; x < pgm.width; x++ {
+			values[y][x] = float64(pgm.data[y][x])
+		}
+	}
+	return values
+}
+
+// gaussianKernel returns a normalized 1D Gaussian kernel with 2*radius+1 taps.
+func gaussianKernel(radius int, sigma float64) []float64 {
+	kernel := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := -radius; i <= radius; i++ {
+		kernel[i+radius] = math.Exp(-float64(i*i) / (2 * sigma * sigma))
+		sum += kernel[i+radius]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// boxKernel returns a normalized 1D box kernel with 2*radius+1 equal taps.
+func boxKernel(radius int) []float64 {
+	kernel := make([]float64, 2*radius+1)
+	for i := range kernel {
+		kernel[i] = 1 / float64(len(kernel))
+	}
+	return kernel
+}
+
+// convolveSeparable applies a symmetric 1D kernel horizontally then vertically,
+// clamping coordinates at the borders so edges are not darkened.
+func convolveSeparable(values [][]float64, kernel []float64) [][]float64 {
+	height := len(values)
+	if height == 0 {
+		return values
+	}
+	width := len(values[0])
+	radius := len(kernel) / 2
+
+	horizontal := make([][]float64, height)
+	for y := 0; y < height; y++ {
+		horizontal[y] = make([]float64, width)
+		for x := 0; x < width; x++ {
+			sum := 0.0
+			for k := -radius; k <= radius; k++ {
+				sum += kernel[k+radius] * values[y][clamp(x+k, 0, width-1)]
+			}
+			horizontal[y][x] = sum
+		}
+	}
+
+	result := make([][]float64, height)
+	for y := 0; y < height; y++ {
+		result[y] = make([]float64, width)
+		for x := 0; x < width; x++ {
+			sum := 0.0
+			for k := -radius; k <= radius; k++ {
+				sum += kernel[k+radius] * horizontal[clamp(y+k, 0, height-1)][x]
+			}
+			result[y][x] = sum
+		}
+	}
+	return result
+}
+
+// validKernel reports whether kernel is non-empty and rectangular.
+func validKernel(kernel [][]float64) bool {
+	if len(kernel) == 0 || len(kernel[0]) == 0 {
+		return false
+	}
+	for _, row := range kernel {
+		if len(row) != len(kernel[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// convolve applies a 2D kernel centered on each value, clamping coordinates at
+// the borders, and returns sum/divisor + offset per value. kernel must be
+// valid; even sizes are centered on index len/2.
+func convolve(values [][]float64, kernel [][]float64, divisor, offset float64) [][]float64 {
+	height := len(values)
+	cy, cx := len(kernel)/2, len(kernel[0])/2
+	result := make([][]float64, height)
+	for y := 0; y < height; y++ {
+		width := len(values[y])
+		result[y] = make([]float64, width)
+		for x := 0; x < width; x++ {
+			sum := 0.0
+			for ky, row := range kernel {
+				source := values[clamp(y+ky-cy, 0, height-1)]
+				for kx, weight := range row {
+					sum += weight * source[clamp(x+kx-cx, 0, width-1)]
+				}
+			}
+			result[y][x] = sum/divisor + offset
+		}
+	}
+	return result
+}
+
+// Convolve applies a user-supplied kernel to the image: each pixel becomes
+// the kernel-weighted sum of its neighborhood, divided by divisor, plus
+// offset. A divisor of 0 is treated as 1. The kernel is centered on row and
+// column len/2, coordinates beyond the borders are clamped to the nearest
+// edge, and results are rounded and clamped to [0, max]. An empty or ragged
+// kernel leaves the image unchanged.
+func (pgm *PGM) Convolve(kernel [][]float64, divisor float64, offset float64) {
+	if !validKernel(kernel) {
+		return
+	}
+	if divisor == 0 {
+		divisor = 1
+	}
+	pgm.setFloatData(convolve(pgm.floatData(), kernel, divisor, offset))
+}
+
+// Quantize4 returns a copy of the image reduced to the four gray levels
+// (0, 85, 170, 255) used by 2-bit e-ink panels. With dither set, the
+// quantization error is spread with Floyd-Steinberg diffusion.
+func (pgm *PGM) Quantize4(dither bool) *PGM {
+	values := pgm.floatData()
+	scale := 255.0
+	if pgm.max > 0 {
+		scale = 255.0 / float64(pgm.max)
+	}
+	for y := range values {
+		for x := range values[y] {
+			values[y][x] *= scale
+		}
+	}
+
+	quantize := func(v float64) float64 {
+		return math.Round(math.Max(0, math.Min(v, 255))/85) * 85
+	}
+	if dither {
+		floydSteinberg(values, quantize)
+	}
+
+	result := &PGM{
+		data:        make([][]uint16, pgm.height),
+		width:       pgm.width,
+		height:      pgm.height,
+		magicNumber: pgm.magicNumber,
+		max:         255,
+	}
+	for y := 0; y < pgm.height; y++ {
+		result.data[y] = make([]uint16, pgm.width)
+		for x := 0; x < pgm.width; x++ {
+			result.data[y][x] = uint16(quantize(values[y][x]))
+		}
+	}
+	return result
+}
+
+// floydSteinberg quantizes values in place, diffusing each pixel's error to
+// its unvisited neighbors with the Floyd-Steinberg weights.
+func floydSteinberg(values [][]float64, quantize func(float64) float64) {
+	for y := range values {
+		for x := range values[y] {
+			old := values[y][x]
+			values[y][x] = quantize(old)
+			diff := old - values[y][x]
+			if x+1 < len(values[y]) {
+				values[y][x+1] += diff * 7 / 16
+			}
+			if y+1 < len(values) {
+				if x > 0 {
+					values[y+1][x-1] += diff * 3 / 16
+				}
+				values[y+1][x] += diff * 5 / 16
+				if x+1 < len(values[y+1]) {
+					values[y+1][x+1] += diff * 1 / 16
+				}
+			}
+		}
+	}
+}
+
+// SampleBilinear returns the value at the fractional coordinates (fx, fy),
+// bilinearly interpolated between the four surrounding pixels.
+// Coordinates outside the image are clamped to the nearest edge.
+func (pgm *PGM) SampleBilinear(fx, fy float64) uint16 {
+	if pgm.width <= 0 || pgm.height <= 0 {
+		return 0
+	}
+	fx = math.Max(0, math.Min(fx, float64(pgm.width-1)))
+	fy = math.Max(0, math.Min(fy, float64(pgm.height-1)))
+
+	x0, y0 := int(fx), int(fy)
+	x1, y1 := min(x0+1, pgm.width-1), min(y0+1, pgm.height-1)
+	tx, ty := fx-float64(x0), fy-float64(y0)
+
+	top := float64(pgm.data[y0][x0])*(1-tx) + float64(pgm.data[y0][x1])*tx
+	bottom := float64(pgm.data[y1][x0])*(1-tx) + float64(pgm.data[y1][x1])*tx
+	return uint16(math.Round(top*(1-ty) + bottom*ty))
+}
+
+// ResizeBilinear resizes the image to newWidth x newHeight, interpolating
+// each output pixel between the four source pixels around its center.
+// Non-positive dimensions leave the image unchanged.
+func (pgm *PGM) ResizeBilinear(newWidth, newHeight int) {
+	if newWidth <= 0 || newHeight <= 0 || pgm.width <= 0 || pgm.height <= 0 {
+		return
+	}
+	scaleX := float64(pgm.width) / float64(newWidth)
+	scaleY := float64(pgm.height) / float64(newHeight)
+	resized := make([][]uint16, newHeight)
+	for y := range resized {
+		resized[y] = make([]uint16, newWidth)
+		fy := (float64(y)+0.5)*scaleY - 0.5
+		for x := range resized[y] {
+			resized[y][x] = pgm.SampleBilinear((float64(x)+0.5)*scaleX-0.5, fy)
+		}
+	}
+	pgm.data = resized
+	pgm.width, pgm.height = newWidth, newHeight
+}
+
+// Upscale enlarges the image by an integer factor, replicating each source
+// pixel into a factor x factor block without any interpolation.
+func (pgm *PGM) Upscale(factor int) error {
+	if factor < 1 {
+		return fmt.Errorf("invalid scale factor: %d", factor)
+	}
+	newData := make([][]uint16, pgm.height*factor)
+	for y := range newData {
+		newData[y] = make([]uint16, pgm.width*factor)
+		for x := range newData[y] {
+			newData[y][x] = pgm.data[y/factor][x/factor]
+		}
+	}
+	pgm.data = newData
+	pgm.width *= factor
+	pgm.height *= factor
+	return nil
+}
+
+// Downscale shrinks the image by an integer factor, averaging each
+// factor x factor block into one pixel. When the dimensions are not
+// divisible by factor, the partial blocks on the right and bottom edges
+// are averaged over the pixels they contain.
+func (pgm *PGM) Downscale(factor int) error {
+	if factor < 1 {
+		return fmt.Errorf("invalid scale factor: %d", factor)
+	}
+	newWidth := (pgm.width + factor - 1) / factor
+	newHeight := (pgm.height + factor - 1) / factor
+	newData := make([][]uint16, newHeight)
+	for y := 0; y < newHeight; y++ {
+		newData[y] = make([]uint16, newWidth)
+		for x := 0; x < newWidth; x++ {
+			sum, count := 0, 0
+			for sy := y * factor; sy < (y+1)*factor && sy < pgm.height; sy++ {
+				for sx := x * factor; sx < (x+1)*factor && sx < pgm.width; sx++ {
+					sum += int(pgm.data[sy][sx])
+					count++
+				}
+			}
+			newData[y][x] = uint16(sum / count)
+		}
+	}
+	pgm.data = newData
+	pgm.width = newWidth
+	pgm.height = newHeight
+	return nil
+}
+
+// CLAHE applies contrast-limited adaptive histogram equalization. The image
+// is divided into tileSize x tileSize tiles, each tile's histogram is clipped
+// at clipLimit times the average bin count (0 disables clipping) and
+// equalized, and the per-tile mappings are bilinearly interpolated.
+func (pgm *PGM) CLAHE(tileSize int, clipLimit float64) {
+	if tileSize <= 0 || pgm.width <= 0 || pgm.height <= 0 {
+		return
+	}
+	bins := int(pgm.max) + 1
+	if bins > 256 {
+		bins = 256
+	}
+	bin := func(value uint16) int {
+		return int(value) * bins / (int(pgm.max) + 1)
+	}
+
+	tilesX := (pgm.width + tileSize - 1) / tileSize
+	tilesY := (pgm.height + tileSize - 1) / tileSize
+	mappings := make([][][]float64, tilesY)
+	for ty := 0; ty < tilesY; ty++ {
+		mappings[ty] = make([][]float64, tilesX)
+		for tx := 0; tx < tilesX; tx++ {
+			histogram := make([]float64, bins)
+			count := 0
+			for y := ty * tileSize; y < min((ty+1)*tileSize, pgm.height); y++ {
+				for x := tx * tileSize; x < min((tx+1)*tileSize, pgm.width); x++ {
+					histogram[bin(pgm.data[y][x])]++
+					count++
+				}
+			}
+
+			if clipLimit > 0 {
+				limit := math.Max(1, clipLimit*float64(count)/float64(bins))
+				excess := 0.0
+				for i := range histogram {
+					if histogram[i] > limit {
+						excess += histogram[i] - limit
+						histogram[i] = limit
+					}
+				}
+				for i := range histogram {
+					histogram[i] += excess / float64(bins)
+				}
+			}
+
+			mapping := make([]float64, bins)
+			cdf := 0.0
+			for i := range histogram {
+				cdf += histogram[i]
+				mapping[i] = cdf * float64(pgm.max) / float64(count)
+			}
+			mappings[ty][tx] = mapping
+		}
+	}
+
+	for y := 0; y < pgm.height; y++ {
+		fy := math.Max(0, (float64(y)+0.5)/float64(tileSize)-0.5)
+		ty0 := min(int(fy), tilesY-1)
+		ty1 := min(ty0+1, tilesY-1)
+		wy := math.Min(fy-float64(ty0), 1)
+		for x := 0; x < pgm.width; x++ {
+			fx := math.Max(0, (float64(x)+0.5)/float64(tileSize)-0.5)
+			tx0 := min(int(fx), tilesX-1)
+			tx1 := min(tx0+1, tilesX-1)
+			wx := math.Min(fx-float64(tx0), 1)
+
+			b := bin(pgm.data[y][x])
+			top := mappings[ty0][tx0][b]*(1-wx) + mappings[ty0][tx1][b]*wx
+			bottom := mappings[ty1][tx0][b]*(1-wx) + mappings[ty1][tx1][b]*wx
+			value := math.Round(top*(1-wy) + bottom*wy)
+			pgm.data[y][x] = uint16(math.Min(value, float64(pgm.max)))
+		}
+	}
+}
+
+// sobel returns the horizontal and vertical Sobel derivatives of the image,
+// clamping coordinates at the borders. Positive gx means brighter to the
+// right; positive gy means brighter below.
+func (pgm *PGM) sobel() (gx, gy [][]float64) {
+	gx = make([][]float64, pgm.height)
+	gy = make([][]float64, pgm.height)
+	at := func(x, y int) float64 {
+		return float64(pgm.data[clamp(y, 0, pgm.height-1)][clamp(x, 0, pgm.width-1)])
+	}
+	for y := 0; y < pgm.height; y++ {
+		gx[y] = make([]float64, pgm.width)
+		gy[y] = make([]float64, pgm.width)
+		for x := 0; x < pgm.width; x++ {
+			gx[y][x] = at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) -
+				at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy[y][x] = at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) -
+				at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+		}
+	}
+	return gx, gy
+}
+
+// GradientDirection returns a new image holding the Sobel gradient angle
+// atan2(gy, gx) of every pixel, mapped linearly from [-pi, pi] to [1, max].
+// The value 0 is reserved for flat pixels, whose gradient has no direction.
+// An angle of 0, a dark-to-bright edge running left to right, maps to the
+// middle of the range. A max of 0 leaves no room for directions, so the
+// result is all zeros.
+func (pgm *PGM) GradientDirection() *PGM {
+	out := NewPGM(pgm.width, pgm.height, pgm.max)
+	out.magicNumber = pgm.magicNumber
+	if pgm.max == 0 {
+		return out
+	}
+	gx, gy := pgm.sobel()
+	for y := 0; y < pgm.height; y++ {
+		for x := 0; x < pgm.width; x++ {
+			if gx[y][x] == 0 && gy[y][x] == 0 {
+				continue
+			}
+			angle := math.Atan2(gy[y][x], gx[y][x])
+			out.data[y][x] = 1 + uint16(math.Round((angle+math.Pi)/(2*math.Pi)*float64(pgm.max-1)))
+		}
+	}
+	return out
+}
+
+// SobelEdges returns a new image holding the Sobel gradient magnitude of
+// every pixel, with borders clamped. Magnitudes are scaled so the strongest
+// edge maps to max; a flat image yields all zeros.
+func (pgm *PGM) SobelEdges() *PGM {
+	out := NewPGM(pgm.width, pgm.height, pgm.max)
+	out.magicNumber = pgm.magicNumber
+	gx, gy := pgm.sobel()
+	strongest := 0.0
+	for y := range gx {
+		for x := range gx[y] {
+			gx[y][x] = math.Hypot(gx[y][x], gy[y][x])
+			strongest = math.Max(strongest, gx[y][x])
+		}
+	}
+	if strongest == 0 {
+		return out
+	}
+	for y := 0; y < pgm.height; y++ {
+		for x := 0; x < pgm.width; x++ {
+			out.data[y][x] = uint16(math.Round(gx[y][x] / strongest * float64(pgm.max)))
+		}
+	}
+	return out
+}
+
+// harrisK is the sensitivity constant of the Harris corner response.
+const harrisK = 0.04
+
+// Corners detects interest points with the Harris corner detector. Sobel
+// gradients of the image, normalized to [0, 1] intensities, are combined into
+// a Gaussian-weighted structure tensor; pixels whose response
+// det - 0.04*trace^2 exceeds threshold and is the maximum of its 5x5
+// neighborhood are returned in raster order.
+func (pgm *PGM) Corners(threshold float64) []Point {
+	if pgm.width == 0 || pgm.height == 0 || pgm.max == 0 {
+		return nil
+	}
+	gx, gy := pgm.sobel()
+	xx := make([][]float64, pgm.height)
+	yy := make([][]float64, pgm.height)
+	xy := make([][]float64, pgm.height)
+	scale := 1 / float64(pgm.max)
+	for y := 0; y < pgm.height; y++ {
+		xx[y] = make([]float64, pgm.width)
+		yy[y] = make([]float64, pgm.width)
+		xy[y] = make([]float64, pgm.width)
+		for x := 0; x < pgm.width; x++ {
+			dx, dy := gx[y][x]*scale, gy[y][x]*scale
+			xx[y][x], yy[y][x], xy[y][x] = dx*dx, dy*dy, dx*dy
+		}
+	}
+	kernel := gaussianKernel(2, 1)
+	xx = convolveSeparable(xx, kernel)
+	yy = convolveSeparable(yy, kernel)
+	xy = convolveSeparable(xy, kernel)
+
+	response := make([][]float64, pgm.height)
+	for y := 0; y < pgm.height; y++ {
+		response[y] = make([]float64, pgm.width)
+		for x := 0; x < pgm.width; x++ {
+			trace := xx[y][x] + yy[y][x]
+			response[y][x] = xx[y][x]*yy[y][x] - xy[y][x]*xy[y][x] - harrisK*trace*trace
+		}
+	}
+
+	const radius = 2
+	var corners []Point
+	for y := 0; y < pgm.height; y++ {
+		for x := 0; x < pgm.width; x++ {
+			r := response[y][x]
+			if r <= threshold || !isLocalMax(response, x, y, radius) {
+				continue
+			}
+			corners = append(corners, Point{X: x, Y: y})
+		}
+	}
+	return corners
+}
+
+// isLocalMax reports whether values[y][x] is the maximum of the window of the
+// given radius around it. Ties go to the first pixel in raster order, so a
+// plateau yields a single maximum.
+func isLocalMax(values [][]float64, x, y, radius int) bool {
+	v := values[y][x]
+	for ny := max(0, y-radius); ny <= min(len(values)-1, y+radius); ny++ {
+		for nx := max(0, x-radius); nx <= min(len(values[ny])-1, x+radius); nx++ {
+			n := values[ny][nx]
+			if n > v || (n == v && (ny < y || (ny == y && nx < x))) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// AdjustBrightness adds delta to every pixel, saturating at 0 and max.
+func (pgm *PGM) AdjustBrightness(delta int) {
+	for y := 0; y < pgm.height; y++ {
+		for x := 0; x < pgm.width; x++ {
+			pgm.data[y][x] = brighten(pgm.data[y][x], delta, pgm.max)
+		}
+	}
+}
+
+// AdjustContrast scales every pixel's distance from mid-gray (max/2) by
+// factor, saturating at 0 and max. A factor of 1 leaves the image unchanged,
+// below 1 flattens it and above 1 increases contrast.
+func (pgm *PGM) AdjustContrast(factor float64) {
+	for y := 0; y < pgm.height; y++ {
+		for x := 0; x < pgm.width; x++ {
+			pgm.data[y][x] = contrast(pgm.data[y][x], factor, pgm.max)
+		}
+	}
+}
+
+// MatchTemplate finds the placement of template within the image with the
+// highest zero-mean normalized cross-correlation. It returns the top-left
+// corner of the best match and its score, from -1 to 1 where 1 is a perfect
+// match up to brightness and contrast. Flat windows score 0. If the template
+// is empty or larger than the image, it returns (Point{}, 0).
+func (pgm *PGM) MatchTemplate(template *PGM) (Point, float64) {
+	tw, th := template.width, template.height
+	if tw == 0 || th == 0 || tw > pgm.width || th > pgm.height {
+		return Point{}, 0
+	}
+	n := float64(tw * th)
+	tmean := 0.0
+	for y := 0; y < th; y++ {
+		for x := 0; x < tw; x++ {
+			tmean += float64(template.data[y][x])
+		}
+	}
+	tmean /= n
+	tnorm := 0.0
+	for y := 0; y < th; y++ {
+		for x := 0; x < tw; x++ {
+			d := float64(template.data[y][x]) - tmean
+			tnorm += d * d
+		}
+	}
+
+	best, bestScore := Point{}, math.Inf(-1)
+	for oy := 0; oy+th <= pgm.height; oy++ {
+		for ox := 0; ox+tw <= pgm.width; ox++ {
+			mean := 0.0
+			for y := 0; y < th; y++ {
+				for x := 0; x < tw; x++ {
+					mean += float64(pgm.data[oy+y][ox+x])
+				}
+			}
+			mean /= n
+			cross, norm := 0.0, 0.0
+			for y := 0; y < th; y++ {
+				for x := 0; x < tw; x++ {
+					d := float64(pgm.data[oy+y][ox+x]) - mean
+					cross += d * (float64(template.data[y][x]) - tmean)
+					norm += d * d
+				}
+			}
+			score := 0.0
+			if norm > 0 && tnorm > 0 {
+				score = cross / math.Sqrt(norm*tnorm)
+			}
+			if score > bestScore {
+				best, bestScore = Point{X: ox, Y: oy}, score
+			}
+		}
+	}
+	return best, bestScore
+}
+
+// ApplyGamma maps every pixel v to max * (v/max)^(1/gamma) through a lookup
+// table. A gamma above 1 brightens mid-tones; values <= 0 are treated as 1.
+func (pgm *PGM) ApplyGamma(gamma float64) {
+	table := levelsTable(pgm.max, 0, float64(pgm.max), gamma)
+	for y := 0; y < pgm.height; y++ {
+		for x := 0; x < pgm.width; x++ {
+			pgm.data[y][x] = table[min(pgm.data[y][x], pgm.max)]
+		}
+	}
+}
+
+// GaussianBlur smooths the image with a Gaussian kernel of 2*radius+1 taps
+// and standard deviation sigma, applied as two separable 1D passes. Borders
+// are clamped so edge pixels are not darkened. A non-positive radius or sigma
+// leaves the image unchanged.
+func (pgm *PGM) GaussianBlur(radius int, sigma float64) {
+	if radius <= 0 || sigma <= 0 {
+		return
+	}
+	pgm.setFloatData(convolveSeparable(pgm.floatData(), gaussianKernel(radius, sigma)))
+}
+
+// setFloatData rounds values back into the image, clamping to [0, max].
+func (pgm *PGM) setFloatData(values [][]float64) {
+	for y := 0; y < pgm.height; y++ {
+		for x := 0; x < pgm.width; x++ {
+			pgm.data[y][x] = uint16(math.Max(0, math.Min(math.Round(values[y][x]), float64(pgm.max))))
+		}
+	}
+}
+
+// Histogram returns the number of pixels at each gray level.
+//
+// The returned slice always has length max+1, whatever the max value, and
+// entry v counts the pixels whose sample is v. Levels are not rebinned to
+// 256 buckets, so an image with max 15 yields 16 entries and one with max
+// 65535 yields 65536. Samples above max are counted at max.
+func (pgm *PGM) Histogram() []int {
+	histogram := make([]int, int(pgm.max)+1)
+	for _, row := range pgm.data {
+		for _, value := range row {
+			histogram[min(value, pgm.max)]++
+		}
+	}
+	return histogram
+}
+
+// OtsuThreshold returns the gray level t that best separates the image into
+// a dark class (samples <= t) and a light class (samples > t) by Otsu's
+// method, which maximizes the between-class variance of the histogram.
+func (pgm *PGM) OtsuThreshold() uint16 {
+	histogram := pgm.Histogram()
+	total, sum := 0, 0.0
+	for level, count := range histogram {
+		total += count
+		sum += float64(level * count)
+	}
+	best, bestVariance := 0, -1.0
+	dark, darkSum := 0, 0.0
+	for level, count := range histogram {
+		dark += count
+		darkSum += float64(level * count)
+		light := total - dark
+		if dark == 0 {
+			continue
+		}
+		if light == 0 {
+			break
+		}
+		meanDark := darkSum / float64(dark)
+		meanLight := (sum - darkSum) / float64(light)
+		variance := float64(dark) * float64(light) * (meanDark - meanLight) * (meanDark - meanLight)
+		if variance > bestVariance {
+			best, bestVariance = level, variance
+		}
+	}
+	return uint16(best)
+}
+
+// ToPBMOtsu converts the PGM image to a PBM image using the threshold chosen
+// by OtsuThreshold: samples at or below it become set (black) pixels.
+func (pgm *PGM) ToPBMOtsu() *PBM {
+	threshold := pgm.OtsuThreshold()
+	pbm := NewPBM(pgm.width, pgm.height)
+	for y := 0; y < pgm.height; y++ {
+		for x := 0; x < pgm.width; x++ {
+			pbm.data[y][x] = pgm.data[y][x] <= threshold
+		}
+	}
+	return pbm
+}
+
+// Normalize stretches the image contrast linearly so that the darkest sample
+// becomes 0 and the lightest becomes the max value, rounding to the nearest
+// level. An image whose samples are all equal is left unchanged.
+func (pgm *PGM) Normalize() {
+	if pgm.width == 0 || pgm.height == 0 {
+		return
+	}
+	low, high := pgm.data[0][0], pgm.data[0][0]
+	for _, row := range pgm.data {
+		for _, value := range row {
+			low, high = min(low, value), max(high, value)
+		}
+	}
+	if low == high {
+		return
+	}
+	scale := float64(pgm.max) / float64(high-low)
+	for _, row := range pgm.data {
+		for x, value := range row {
+			row[x] = uint16(math.Round(float64(value-low) * scale))
+		}
+	}
+}
+
+// IsBlank reports whether the image looks like an empty page: the fraction of
+// pixels that differ from the background, taken to be the most common gray
+// level, is below threshold. An image with no pixels is blank.
+func (pgm *PGM) IsBlank(threshold float64) bool {
+	total := pgm.width * pgm.height
+	if total == 0 {
+		return true
+	}
+	background := 0
+	for _, count := range pgm.Histogram() {
+		background = max(background, count)
+	}
+	return float64(total-background)/float64(total) < threshold
+}
+
+// ToPBMDithered converts the PGM image to a PBM image with Floyd-Steinberg
+// error diffusion, so gradients become varying densities of black pixels
+// instead of a single hard edge. The image itself is not modified.
+func (pgm *PGM) ToPBMDithered() *PBM {
+	values := pgm.floatData()
+	white := float64(pgm.max)
+	floydSteinberg(values, func(v float64) float64 {
+		if v < white/2 {
+			return 0
+		}
+		return white
+	})
+	pbm := NewPBM(pgm.width, pgm.height)
+	for y := range values {
+		for x := range values[y] {
+			pbm.data[y][x] = values[y][x] == 0
+		}
+	}
+	return pbm
+}
+
+// Translate shifts the image by dx pixels right and dy pixels down. With mode
+// "wrap" pixels pushed off one edge reappear on the opposite one; with mode
+// "fill" they are dropped and the uncovered pixels take fill. It returns an
+// error, leaving the image unchanged, for any other mode.
+func (pgm *PGM) Translate(dx, dy int, mode string, fill uint16) error {
+	source, err := translation(dx, dy, pgm.width, pgm.height, mode)
+	if err != nil {
+		return err
+	}
+	data := NewPGM(pgm.width, pgm.height, pgm.max).data
+	for y := range data {
+		for x := range data[y] {
+			sx, sy, ok := source(x, y)
+			if !ok {
+				data[y][x] = fill
+				continue
+			}
+			data[y][x] = pgm.data[sy][sx]
+		}
+	}
+	pgm.data = data
+	return nil
+}
+
+// Entropy returns the Shannon entropy, in bits per pixel, of the image's
+// gray-level histogram: 0 for a uniform image, up to log2(max+1) when every
+// level is equally common.
+func (pgm *PGM) Entropy() float64 {
+	total := float64(pgm.width * pgm.height)
+	if total == 0 {
+		return 0
+	}
+	entropy := 0.0
+	for _, count := range pgm.Histogram() {
+		if count > 0 {
+			p := float64(count) / total
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
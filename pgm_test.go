@@ -0,0 +1,833 @@
+package Netpbm
+
+import (
+	"image"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newPGMFrom builds a PGM from rows of samples.
+func newPGMFrom(max uint16, rows ...[]uint16) *PGM {
+	pgm := NewPGM(len(rows[0]), len(rows), max)
+	for y, row := range rows {
+		copy(pgm.data[y], row)
+	}
+	return pgm
+}
+
+func TestForEachNeighborhoodClampsAtCorner(t *testing.T) {
+	pgm := newPGMFrom(255,
+		[]uint16{1, 2, 3},
+		[]uint16{4, 5, 6},
+		[]uint16{7, 8, 9},
+	)
+	calls := 0
+	pgm.ForEachNeighborhood(1, func(x, y int, window [][]uint16) {
+		calls++
+		if len(window) != 3 || len(window[0]) != 3 {
+			t.Fatalf("window at (%d,%d) is %dx%d, want 3x3", x, y, len(window[0]), len(window))
+		}
+		if x == 0 && y == 0 {
+			want := [][]uint16{{1, 1, 2}, {1, 1, 2}, {4, 4, 5}}
+			if !reflect.DeepEqual(window, want) {
+				t.Errorf("corner window = %v, want %v", window, want)
+			}
+		}
+	})
+	if calls != 9 {
+		t.Errorf("fn called %d times, want 9", calls)
+	}
+}
+
+func TestMaxMinFilter(t *testing.T) {
+	spot := func() *PGM {
+		pgm := NewPGM(5, 5, 255)
+		pgm.data[2][2] = 200
+		return pgm
+	}
+
+	grown := spot()
+	grown.MaxFilter(1)
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 5; x++ {
+			want := uint16(0)
+			if x >= 1 && x <= 3 && y >= 1 && y <= 3 {
+				want = 200
+			}
+			if grown.data[y][x] != want {
+				t.Errorf("MaxFilter: pixel (%d,%d) = %d, want %d", x, y, grown.data[y][x], want)
+			}
+		}
+	}
+
+	eroded := spot()
+	eroded.MinFilter(1)
+	if eroded.data[2][2] != 0 {
+		t.Errorf("MinFilter should remove an isolated bright pixel, got %d", eroded.data[2][2])
+	}
+}
+
+// variance returns the variance of the samples in [x0, x1) x [y0, y1).
+func variance(pgm *PGM, x0, y0, x1, y1 int) float64 {
+	var sum, sq float64
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			v := float64(pgm.data[y][x])
+			sum += v
+			sq += v * v
+		}
+	}
+	n := float64((x1 - x0) * (y1 - y0))
+	return sq/n - (sum/n)*(sum/n)
+}
+
+func TestBilateralFilterKeepsEdges(t *testing.T) {
+	pgm := NewPGM(20, 20, 255)
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			base := 50
+			if x >= 10 {
+				base = 200
+			}
+			pgm.data[y][x] = uint16(base + (x*7+y*13)%11 - 5)
+		}
+	}
+	before := variance(pgm, 0, 0, 8, 20)
+	pgm.BilateralFilter(2, 20)
+
+	if after := variance(pgm, 0, 0, 8, 20); after >= before/2 {
+		t.Errorf("flat-region variance went from %.1f to %.1f, want it at least halved", before, after)
+	}
+	for y := 0; y < 20; y++ {
+		if left, right := pgm.data[y][9], pgm.data[y][10]; left > 60 || right < 190 {
+			t.Errorf("row %d: edge blurred to %d|%d", y, left, right)
+		}
+	}
+}
+
+func TestHeatmap(t *testing.T) {
+	pgm := newPGMFrom(255, []uint16{30, 80, 130})
+	heat := pgm.Heatmap()
+	want := []Pixel{{B: 255}, {G: 255}, {R: 255}}
+	for x, color := range want {
+		if got := heat.At(x, 0); got != color {
+			t.Errorf("pixel %d = %v, want %v", x, got, color)
+		}
+	}
+}
+
+func TestDoGCenterSurround(t *testing.T) {
+	pgm := NewPGM(21, 21, 255)
+	pgm.ClearRect(image.Rect(9, 9, 12, 12), 255)
+	pgm.DoG(1, 3)
+	mid := uint16(128)
+	if c := pgm.data[10][10]; c <= mid {
+		t.Errorf("center response %d, want above mid-gray %d", c, mid)
+	}
+	if ring := pgm.data[10][15]; ring >= mid-1 {
+		t.Errorf("surround response %d, want below mid-gray %d", ring, mid)
+	}
+}
+
+// gradient returns a width x height PGM whose samples rise from 0 on the left
+// to max on the right.
+func gradient(width, height int, max uint16) *PGM {
+	pgm := NewPGM(width, height, max)
+	for y := range pgm.data {
+		for x := range pgm.data[y] {
+			pgm.data[y][x] = uint16(x * int(max) / (width - 1))
+		}
+	}
+	return pgm
+}
+
+func TestQuantize4Levels(t *testing.T) {
+	for _, dither := range []bool{false, true} {
+		for _, max := range []uint16{255, 1000} {
+			quantized := gradient(50, 10, max).Quantize4(dither)
+			for y := range quantized.data {
+				for x, v := range quantized.data[y] {
+					if v != 0 && v != 85 && v != 170 && v != 255 {
+						t.Fatalf("dither=%v max=%d: pixel (%d,%d) = %d, not one of the four levels", dither, max, x, y, v)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPGMUpscaleReplicatesPixels(t *testing.T) {
+	pgm := newPGMFrom(255, []uint16{10, 20}, []uint16{30, 40})
+	if err := pgm.Upscale(3); err != nil {
+		t.Fatal(err)
+	}
+	want := newPGMFrom(255,
+		[]uint16{10, 10, 10, 20, 20, 20},
+		[]uint16{10, 10, 10, 20, 20, 20},
+		[]uint16{10, 10, 10, 20, 20, 20},
+		[]uint16{30, 30, 30, 40, 40, 40},
+		[]uint16{30, 30, 30, 40, 40, 40},
+		[]uint16{30, 30, 30, 40, 40, 40},
+	)
+	if !reflect.DeepEqual(pgm.data, want.data) || pgm.width != 6 || pgm.height != 6 {
+		t.Errorf("upscaled = %v, want %v", pgm.data, want.data)
+	}
+}
+
+func TestPGMDownscaleAveragesBlocks(t *testing.T) {
+	pgm := newPGMFrom(255,
+		[]uint16{0, 4, 10, 10},
+		[]uint16{8, 12, 20, 20},
+		[]uint16{1, 1, 100, 200},
+		[]uint16{1, 1, 200, 100},
+	)
+	if err := pgm.Downscale(2); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]uint16{{6, 15}, {1, 150}}
+	if !reflect.DeepEqual(pgm.data, want) || pgm.width != 2 || pgm.height != 2 {
+		t.Errorf("downscaled = %v, want %v", pgm.data, want)
+	}
+}
+
+func TestCLAHE(t *testing.T) {
+	// Left half: a low-contrast texture. Right half: perfectly flat.
+	pgm := NewPGM(64, 32, 255)
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			if x < 32 {
+				pgm.data[y][x] = uint16(100 + (x*3+y*5)%11)
+			} else {
+				pgm.data[y][x] = 128
+			}
+		}
+	}
+	textureBefore := variance(pgm, 0, 0, 32, 32)
+	pgm.CLAHE(16, 2)
+	if after := variance(pgm, 0, 0, 32, 32); after < 4*textureBefore {
+		t.Errorf("texture variance %.1f -> %.1f, want local contrast to increase", textureBefore, after)
+	}
+	// Stay clear of the seam, where the mapping blends with the textured tiles.
+	if flat := variance(pgm, 48, 0, 64, 32); flat > 1 {
+		t.Errorf("flat region variance = %.1f, want it to stay flat instead of turning to noise", flat)
+	}
+}
+
+func TestResizeBilinearUpsample(t *testing.T) {
+	pgm := newPGMFrom(255, []uint16{0, 100}, []uint16{100, 200})
+	pgm.ResizeBilinear(4, 4)
+	// Destination pixel centers map to source coordinates 0, 0.25, 0.75
+	// and 1 once clamped to the edge samples.
+	coords := []int{0, 25, 75, 100}
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if want := uint16(coords[x] + coords[y]); pgm.At(x, y) != want {
+				t.Errorf("pixel (%d,%d) = %d, want %d", x, y, pgm.At(x, y), want)
+			}
+		}
+	}
+
+	ppm := NewPPM(2, 2, 255)
+	ppm.Set(1, 0, Pixel{100, 0, 0})
+	ppm.Set(0, 1, Pixel{0, 100, 0})
+	ppm.Set(1, 1, Pixel{100, 100, 160})
+	ppm.ResizeBilinear(4, 4)
+	if got, want := ppm.At(1, 2), (Pixel{25, 75, 30}); got != want {
+		t.Errorf("PPM pixel (1,2) = %v, want %v", got, want)
+	}
+}
+
+func TestGradientDirectionVerticalEdge(t *testing.T) {
+	// Dark on the left, bright on the right: the gradient points along +x,
+	// an angle of 0, in the two columns either side of the edge.
+	pgm := NewPGM(8, 6, 255)
+	for y := 0; y < 6; y++ {
+		for x := 4; x < 8; x++ {
+			pgm.data[y][x] = 200
+		}
+	}
+	direction := pgm.GradientDirection()
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 8; x++ {
+			got := direction.data[y][x]
+			if x == 3 || x == 4 {
+				if got < 127 || got > 129 {
+					t.Errorf("edge pixel (%d,%d) = %d, want about 128", x, y, got)
+				}
+			} else if got != 0 {
+				t.Errorf("flat pixel (%d,%d) = %d, want 0", x, y, got)
+			}
+		}
+	}
+
+	// The opposite edge points along -x, at either end of the range.
+	pgm.Invert()
+	if got := pgm.GradientDirection().data[2][3]; got != 1 && got != 255 {
+		t.Errorf("inverted edge = %d, want 1 or 255", got)
+	}
+
+	// With max 0 there is no room for directions; nothing may wrap around.
+	zero := NewPGM(4, 3, 0)
+	zero.data[1][2] = 1
+	direction = zero.GradientDirection()
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 4; x++ {
+			if got := direction.data[y][x]; got != 0 {
+				t.Errorf("max 0 pixel (%d,%d) = %d, want 0", x, y, got)
+			}
+		}
+	}
+}
+
+func TestCornersOfSquare(t *testing.T) {
+	pgm := NewPGM(40, 40, 255)
+	for y := 10; y < 30; y++ {
+		for x := 10; x < 30; x++ {
+			pgm.data[y][x] = 255
+		}
+	}
+	corners := pgm.Corners(0.5)
+	expected := []Point{{10, 10}, {29, 10}, {10, 29}, {29, 29}}
+	near := func(p, q Point) bool {
+		return max(p.X-q.X, q.X-p.X) <= 2 && max(p.Y-q.Y, q.Y-p.Y) <= 2
+	}
+	for _, want := range expected {
+		found := false
+		for _, p := range corners {
+			found = found || near(p, want)
+		}
+		if !found {
+			t.Errorf("no corner detected near %v; got %v", want, corners)
+		}
+	}
+	for _, p := range corners {
+		ok := false
+		for _, want := range expected {
+			ok = ok || near(p, want)
+		}
+		if !ok {
+			t.Errorf("corner %v is not near a square corner", p)
+		}
+	}
+	if flat := NewPGM(20, 20, 255).Corners(0.5); len(flat) != 0 {
+		t.Errorf("flat image has corners %v", flat)
+	}
+}
+
+func TestAdjustBrightnessAndContrast(t *testing.T) {
+	row := []uint16{0, 10, 128, 250, 255}
+	for _, tc := range []struct {
+		name   string
+		adjust func(*PGM)
+		want   []uint16
+	}{
+		{"brightness +20", func(p *PGM) { p.AdjustBrightness(20) }, []uint16{20, 30, 148, 255, 255}},
+		{"brightness -20", func(p *PGM) { p.AdjustBrightness(-20) }, []uint16{0, 0, 108, 230, 235}},
+		{"brightness 0", func(p *PGM) { p.AdjustBrightness(0) }, row},
+		{"contrast 2", func(p *PGM) { p.AdjustContrast(2) }, []uint16{0, 0, 129, 255, 255}},
+		{"contrast 0", func(p *PGM) { p.AdjustContrast(0) }, []uint16{128, 128, 128, 128, 128}},
+		{"contrast 1", func(p *PGM) { p.AdjustContrast(1) }, row},
+	} {
+		pgm := newPGMFrom(255, append([]uint16(nil), row...))
+		tc.adjust(pgm)
+		if !reflect.DeepEqual(pgm.data[0], tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, pgm.data[0], tc.want)
+		}
+	}
+
+	ppm := NewPPM(1, 1, 255)
+	ppm.Set(0, 0, Pixel{5, 128, 250})
+	ppm.AdjustBrightness(-10)
+	if got := ppm.At(0, 0); got != (Pixel{0, 118, 240}) {
+		t.Errorf("PPM brightness -10 = %v, want {0 118 240}", got)
+	}
+	ppm.AdjustContrast(1)
+	if got := ppm.At(0, 0); got != (Pixel{0, 118, 240}) {
+		t.Errorf("PPM contrast 1 changed the pixel to %v", got)
+	}
+}
+
+func TestMatchTemplate(t *testing.T) {
+	pgm := NewPGM(30, 20, 255)
+	for y := range pgm.data {
+		for x := range pgm.data[y] {
+			pgm.data[y][x] = uint16((x*7 + y*3) % 40)
+		}
+	}
+	patch := newPGMFrom(255,
+		[]uint16{200, 10, 200, 10},
+		[]uint16{10, 250, 10, 250},
+		[]uint16{200, 10, 90, 10},
+	)
+	for y := range patch.data {
+		copy(pgm.data[11+y][17:], patch.data[y])
+	}
+	at, score := pgm.MatchTemplate(patch)
+	if at != (Point{17, 11}) {
+		t.Errorf("MatchTemplate found %v, want {17 11}", at)
+	}
+	if score < 0.99 {
+		t.Errorf("score = %.3f, want close to 1", score)
+	}
+}
+
+func TestApplyGamma(t *testing.T) {
+	row := []uint16{0, 64, 128, 255}
+	for _, tc := range []struct {
+		gamma float64
+		want  []uint16
+	}{
+		{1, row},
+		{2.2, []uint16{0, 136, 186, 255}},
+		{0.45, []uint16{0, 12, 55, 255}},
+	} {
+		pgm := newPGMFrom(255, append([]uint16(nil), row...))
+		pgm.ApplyGamma(tc.gamma)
+		if !reflect.DeepEqual(pgm.data[0], tc.want) {
+			t.Errorf("PGM gamma %v: got %v, want %v", tc.gamma, pgm.data[0], tc.want)
+		}
+
+		ppm := NewPPM(4, 1, 255)
+		for x, v := range row {
+			ppm.Set(x, 0, Pixel{v, v, v})
+		}
+		ppm.ApplyGamma(tc.gamma)
+		for x, v := range tc.want {
+			if got := ppm.At(x, 0); got != (Pixel{v, v, v}) {
+				t.Errorf("PPM gamma %v: pixel %d = %v, want %d", tc.gamma, x, got, v)
+			}
+		}
+	}
+}
+
+func TestSetMaxValueDitheredAvoidsBands(t *testing.T) {
+	const width, height = 96, 32
+	plain := gradient(width, height, 65535)
+	dithered := gradient(width, height, 65535)
+	plain.SetMaxValue(3)
+	dithered.SetMaxValueDithered(3)
+	if dithered.max != 3 {
+		t.Fatalf("max = %d, want 3", dithered.max)
+	}
+
+	// Column means: the plain rescale is a staircase off by up to half a
+	// level, the dithered one follows the ramp.
+	worst := func(pgm *PGM) float64 {
+		worst := 0.0
+		for x := 8; x < width-8; x++ {
+			sum := 0.0
+			for y := 0; y < height; y++ {
+				sum += float64(pgm.data[y][x])
+			}
+			ideal := 3 * float64(x) / float64(width-1)
+			worst = math.Max(worst, math.Abs(sum/height-ideal))
+		}
+		return worst
+	}
+	if got := worst(dithered); got > 0.2 {
+		t.Errorf("dithered column mean strays %.2f levels from the ramp, want <= 0.2", got)
+	}
+	if got := worst(plain); got < 0.4 {
+		t.Errorf("plain rescale strays only %.2f levels; test gradient is not banding", got)
+	}
+
+	// Down a single column next to a band boundary the plain output is flat
+	// while the dithered one mixes the two levels.
+	boundary := width / 6
+	if v := variance(plain, boundary, 0, boundary+1, height); v != 0 {
+		t.Errorf("plain column variance = %.2f, want 0", v)
+	}
+	if v := variance(dithered, boundary, 0, boundary+1, height); v == 0 {
+		t.Error("dithered output is flat at the band boundary")
+	}
+}
+
+func TestGaussianBlurSymmetricFalloff(t *testing.T) {
+	pgm := NewPGM(11, 11, 1000)
+	pgm.data[5][5] = 1000
+	pgm.GaussianBlur(3, 1.2)
+	center := pgm.data[5][5]
+	if center == 0 || center == 1000 {
+		t.Fatalf("center = %d, want it spread out", center)
+	}
+	for d := 1; d <= 3; d++ {
+		ring := []uint16{pgm.data[5][5+d], pgm.data[5][5-d], pgm.data[5+d][5], pgm.data[5-d][5]}
+		for _, v := range ring[1:] {
+			if v != ring[0] {
+				t.Errorf("distance %d: values %v are not symmetric", d, ring)
+				break
+			}
+		}
+		if ring[0] >= pgm.data[5][5+d-1] {
+			t.Errorf("distance %d: %d does not fall off from %d", d, ring[0], pgm.data[5][5+d-1])
+		}
+		if pgm.data[5+d][5+d] != pgm.data[5-d][5-d] || pgm.data[5+d][5-d] != pgm.data[5-d][5+d] {
+			t.Errorf("distance %d: diagonals are not symmetric", d)
+		}
+	}
+
+	ppm := NewPPM(9, 9, 255)
+	ppm.Set(4, 4, Pixel{255, 0, 255})
+	ppm.GaussianBlur(2, 1)
+	if left, right := ppm.At(3, 4), ppm.At(5, 4); left != right || left.R == 0 || left.G != 0 {
+		t.Errorf("PPM neighbors %v and %v, want equal non-zero red and blue", left, right)
+	}
+}
+
+func TestSobelEdgesVerticalBoundary(t *testing.T) {
+	ppm := NewPPM(10, 6, 255)
+	for y := 0; y < 6; y++ {
+		for x := 5; x < 10; x++ {
+			ppm.Set(x, y, Pixel{255, 255, 255})
+		}
+	}
+	for name, edges := range map[string]*PGM{"PPM": ppm.SobelEdges(), "PGM": ppm.ToPGM().SobelEdges()} {
+		for y := 0; y < 6; y++ {
+			for x := 0; x < 10; x++ {
+				got := edges.At(x, y)
+				if x == 4 || x == 5 {
+					if got != edges.max {
+						t.Errorf("%s: edge pixel (%d,%d) = %d, want %d", name, x, y, got, edges.max)
+					}
+				} else if got != 0 {
+					t.Errorf("%s: pixel (%d,%d) away from the edge = %d, want 0", name, x, y, got)
+				}
+			}
+		}
+	}
+}
+
+func TestMedianFilterRemovesNoise(t *testing.T) {
+	// Left half 50, right half 200, with salt and pepper on both sides.
+	pgm := NewPGM(12, 8, 255)
+	for y := range pgm.data {
+		for x := range pgm.data[y] {
+			pgm.data[y][x] = 50
+			if x >= 6 {
+				pgm.data[y][x] = 200
+			}
+		}
+	}
+	clean := pgm.Clone()
+	pgm.data[2][2] = 255
+	pgm.data[5][3] = 0
+	pgm.data[3][9] = 0
+	pgm.data[6][8] = 255
+	pgm.MedianFilter(1)
+	if !pgm.Equal(clean) {
+		t.Errorf("median filter left %v, want %v", pgm.data, clean.data)
+	}
+
+	ppm := filledPPM(5, 5, Pixel{10, 20, 30})
+	ppm.Set(2, 2, white)
+	ppm.MedianFilter(1)
+	if got := ppm.At(2, 2); got != (Pixel{10, 20, 30}) {
+		t.Errorf("PPM noise pixel = %v, want {10 20 30}", got)
+	}
+}
+
+func TestConvolve(t *testing.T) {
+	identity := [][]float64{{0, 0, 0}, {0, 1, 0}, {0, 0, 0}}
+	pgm := newPGMFrom(255, []uint16{10, 10, 10, 50, 50, 50}, []uint16{3, 200, 7, 0, 255, 9})
+	original := pgm.Clone()
+	pgm.Convolve(identity, 1, 0)
+	if !pgm.Equal(original) {
+		t.Errorf("identity kernel changed the image to %v", pgm.data)
+	}
+
+	// A horizontal difference with a bias of 100 responds only at the step.
+	edge := newPGMFrom(255, []uint16{10, 10, 10, 50, 50, 50})
+	edge.Convolve([][]float64{{-1, 0, 1}}, 1, 100)
+	if want := []uint16{100, 100, 140, 140, 100, 100}; !reflect.DeepEqual(edge.data[0], want) {
+		t.Errorf("edge kernel = %v, want %v", edge.data[0], want)
+	}
+	// Results are clamped to [0, max].
+	edge = newPGMFrom(255, []uint16{0, 255, 0})
+	edge.Convolve([][]float64{{-1, 0, 1}}, 1, 0)
+	if want := []uint16{255, 0, 0}; !reflect.DeepEqual(edge.data[0], want) {
+		t.Errorf("clamped edge kernel = %v, want %v", edge.data[0], want)
+	}
+
+	ppm := filledPPM(3, 3, Pixel{1, 2, 3})
+	ppm.Set(1, 1, Pixel{90, 80, 70})
+	before := ppm.Clone()
+	ppm.Convolve(identity, 1, 0)
+	if !ppm.Equal(before) {
+		t.Error("identity kernel changed the PPM image")
+	}
+}
+
+func TestReadPGMPreviewMatchesNearestNeighbor(t *testing.T) {
+	full := NewPGM(100, 70, 255)
+	full.SetMagicNumber("P5")
+	for y := range full.data {
+		for x := range full.data[y] {
+			full.data[y][x] = uint16((x*3 + y*7) % 256)
+		}
+	}
+	filename := filepath.Join(t.TempDir(), "big.pgm")
+	if err := full.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	preview, err := ReadPGMPreview(filename, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The smallest step bringing 100 down to 30 is 4: 25x18.
+	const step = 4
+	if w, h := preview.Size(); w != 25 || h != 18 {
+		t.Fatalf("preview size = %dx%d, want 25x18", w, h)
+	}
+	for y := 0; y < 18; y++ {
+		for x := 0; x < 25; x++ {
+			if got, want := preview.At(x, y), full.At(x*step, y*step); got != want {
+				t.Errorf("preview (%d,%d) = %d, want %d", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestSetMaxValueRoundTrip(t *testing.T) {
+	row := make([]uint16, 256)
+	for v := range row {
+		row[v] = uint16(v)
+	}
+	pgm := newPGMFrom(255, row)
+	pgm.SetMaxValue(15)
+	for x := 1; x < 256; x++ {
+		if pgm.data[0][x] > 15 {
+			t.Fatalf("sample %d = %d exceeds the new max 15", x, pgm.data[0][x])
+		}
+		if pgm.data[0][x] < pgm.data[0][x-1] {
+			t.Fatalf("downscaled samples are not monotonic at %d", x)
+		}
+	}
+	if pgm.data[0][0] != 0 || pgm.data[0][255] != 15 || pgm.data[0][8] != 0 || pgm.data[0][9] != 1 {
+		t.Errorf("rounding: 0->%d 8->%d 9->%d 255->%d, want 0 0 1 15", pgm.data[0][0], pgm.data[0][8], pgm.data[0][9], pgm.data[0][255])
+	}
+
+	pgm.SetMaxValue(255)
+	for x := 0; x < 256; x++ {
+		if got := pgm.data[0][x]; got%17 != 0 {
+			t.Errorf("upscaled sample %d = %d, want a multiple of 17", x, got)
+		}
+		if diff := int(pgm.data[0][x]) - x; diff < -9 || diff > 9 {
+			t.Errorf("sample %d came back as %d", x, pgm.data[0][x])
+		}
+	}
+
+	pgm.SetMaxValue(0)
+	if pgm.max != 255 {
+		t.Errorf("SetMaxValue(0) changed the max to %d", pgm.max)
+	}
+
+	ppm := filledPPM(1, 1, Pixel{255, 128, 0})
+	ppm.SetMaxValue(15)
+	if got := ppm.At(0, 0); got != (Pixel{15, 8, 0}) || ppm.max != 15 {
+		t.Errorf("PPM pixel = %v max %d, want {15 8 0} max 15", got, ppm.max)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	pgm := newPGMFrom(15,
+		[]uint16{0, 0, 3, 15},
+		[]uint16{3, 3, 7, 20},
+	)
+	histogram := pgm.Histogram()
+	if len(histogram) != 16 {
+		t.Fatalf("len = %d, want max+1 = 16", len(histogram))
+	}
+	want := make([]int, 16)
+	want[0], want[3], want[7], want[15] = 2, 3, 1, 2
+	if !reflect.DeepEqual(histogram, want) {
+		t.Errorf("Histogram() = %v, want %v", histogram, want)
+	}
+	if got := len(NewPGM(1, 1, 65535).Histogram()); got != 65536 {
+		t.Errorf("16-bit histogram has %d entries, want 65536", got)
+	}
+}
+
+func TestOtsuThresholdBimodal(t *testing.T) {
+	// Two clusters: 30..50 and 180..210, with nothing in between.
+	pgm := NewPGM(40, 20, 255)
+	for y := range pgm.data {
+		for x := range pgm.data[y] {
+			if x < 25 {
+				pgm.data[y][x] = uint16(30 + (x*3+y)%21)
+			} else {
+				pgm.data[y][x] = uint16(180 + (x+y*7)%31)
+			}
+		}
+	}
+	threshold := pgm.OtsuThreshold()
+	if threshold < 50 || threshold >= 180 {
+		t.Errorf("OtsuThreshold() = %d, want it in the gap [50, 180)", threshold)
+	}
+	pbm := pgm.ToPBMOtsu()
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			if got, want := pbm.At(x, y), x < 25; got != want {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	pgm := newPGMFrom(255, []uint16{40, 60, 90}, []uint16{50, 40, 80})
+	pgm.Normalize()
+	want := [][]uint16{{0, 102, 255}, {51, 0, 204}}
+	if !reflect.DeepEqual(pgm.data, want) {
+		t.Errorf("Normalize() = %v, want %v", pgm.data, want)
+	}
+
+	flat := newPGMFrom(255, []uint16{70, 70}, []uint16{70, 70})
+	flat.Normalize()
+	if !reflect.DeepEqual(flat.data, [][]uint16{{70, 70}, {70, 70}}) {
+		t.Errorf("constant image changed to %v", flat.data)
+	}
+}
+
+func TestPGMToPBMThreshold(t *testing.T) {
+	pgm := newPGMFrom(255, []uint16{0, 100, 127, 128, 200, 255})
+	for _, tc := range []struct {
+		threshold uint8
+		want      string
+	}{
+		{0, "000000"},
+		{128, "111000"},
+		{255, "111110"},
+	} {
+		got := pgm.ToPBMThreshold(tc.threshold)
+		if diff, err := got.Diff(newPBMFrom(tc.want)); err != nil || diff != 0 {
+			t.Errorf("ToPBMThreshold(%d) = %v, want %s", tc.threshold, got.data, tc.want)
+		}
+	}
+
+	// Samples are scaled to 0-255 before the comparison.
+	wide := newPGMFrom(1000, []uint16{0, 400, 600, 1000})
+	if got := wide.ToPBMThreshold(128); !got.Equal(newPBMFrom("1100")) {
+		t.Errorf("max 1000 ToPBMThreshold(128) = %v, want 1100", got.data)
+	}
+}
+
+func TestPGMToPBMMatchesThreshold128(t *testing.T) {
+	for _, max := range []uint16{255, 1000} {
+		pgm := gradient(64, 2, max)
+		got, want := pgm.ToPBM(), pgm.ToPBMThreshold(128)
+		if !got.Equal(want) {
+			t.Errorf("max %d: ToPBM() = %v, want ToPBMThreshold(128) = %v", max, got.data, want.data)
+		}
+	}
+}
+
+func TestIsBlank(t *testing.T) {
+	page := NewPGM(100, 100, 255)
+	for y := range page.data {
+		for x := range page.data[y] {
+			page.data[y][x] = 255
+		}
+	}
+	if !page.IsBlank(0.01) {
+		t.Error("all-white page is not blank")
+	}
+	// A 20x10 block of text covers 2% of the page.
+	for y := 40; y < 50; y++ {
+		for x := 10; x < 30; x++ {
+			page.data[y][x] = uint16((x + y) % 2 * 40)
+		}
+	}
+	if page.IsBlank(0.01) {
+		t.Error("page with a text region is blank at 1%")
+	}
+	if !page.IsBlank(0.05) {
+		t.Error("page with 2% text is not blank at 5%")
+	}
+}
+
+func TestToPBMDitheredDensity(t *testing.T) {
+	const width, height = 64, 32
+	pbm := gradient(width, height, 255).ToPBMDithered()
+	// Black density per 8-column band must fall as the gradient brightens.
+	previous := 2.0
+	for band := 0; band < width/8; band++ {
+		black := 0
+		for y := 0; y < height; y++ {
+			for x := band * 8; x < band*8+8; x++ {
+				if pbm.At(x, y) {
+					black++
+				}
+			}
+		}
+		density := float64(black) / (8 * height)
+		if density >= previous {
+			t.Errorf("band %d density %.2f does not fall from %.2f", band, density, previous)
+		}
+		previous = density
+	}
+	if !pbm.At(0, 0) || pbm.At(width-1, 0) {
+		t.Error("gradient ends are not solid black and white")
+	}
+}
+
+func TestRotateNearestNeighborKeepsLabels(t *testing.T) {
+	mask := newPBMFrom(
+		"0011100",
+		"0111110",
+		"1110011",
+		"0111110",
+		"0011100",
+	)
+	pgm := mask.ToPGM(255)
+	pgm.RotateInterpolated(33, 128, NearestNeighbor)
+	for y := range pgm.data {
+		for x, v := range pgm.data[y] {
+			if v != 0 && v != 255 && v != 128 {
+				t.Fatalf("pixel (%d,%d) = %d, not a source value or the background", x, y, v)
+			}
+		}
+	}
+
+	// Bilinear does create intermediate values, which is why labels need
+	// nearest-neighbor.
+	smooth := mask.ToPGM(255)
+	smooth.RotateInterpolated(33, 0, Bilinear)
+	found := false
+	for y := range smooth.data {
+		for _, v := range smooth.data[y] {
+			found = found || (v != 0 && v != 255)
+		}
+	}
+	if !found {
+		t.Error("bilinear rotation produced no intermediate values")
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	uniform := NewPGM(8, 4, 255)
+	if got := uniform.Entropy(); got != 0 {
+		t.Errorf("uniform Entropy() = %v, want 0", got)
+	}
+
+	// Every one of the 16 levels appears exactly twice.
+	varied := NewPGM(8, 4, 15)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 8; x++ {
+			varied.data[y][x] = uint16((y*8 + x) % 16)
+		}
+	}
+	if got := varied.Entropy(); math.Abs(got-4) > 1e-9 {
+		t.Errorf("varied Entropy() = %v, want log2(16) = 4", got)
+	}
+
+	// Two levels in equal proportion carry exactly one bit.
+	half := newPGMFrom(255,
+		[]uint16{0, 255},
+		[]uint16{255, 0},
+	)
+	if got := half.Entropy(); math.Abs(got-1) > 1e-9 {
+		t.Errorf("two-level Entropy() = %v, want 1", got)
+	}
+}
@@ -3,125 +3,206 @@ package Netpbm
 import (
 	"bufio"
 	"fmt"
+	"image"
 	"io"
 	"math"
 	"os"
 	"sort"
-	"strings"
+	"time"
 )
 
 type PPM struct {
 	data          [][]Pixel
+	pix           []Pixel // flat backing store of data, when contiguous
 	width, height int
 	magicNumber   string
-	max           uint8
+	max           uint16
+	comments      []string
+	metadata      map[string]string
 }
 
 type Pixel struct {
-	R, G, B uint8
+	R, G, B uint16
+}
+
+// channelNames names the Pixel channels in R, G, B order for error messages.
+var channelNames = [3]string{"Red", "Green", "Blue"}
+
+// NewPPM creates a black P3 PPM image of the given size and max value. The
+// pixels live in a single contiguous allocation sliced into rows, so the
+// number of allocations does not grow with the height. Rows stay independent:
+// each is capped at its own width, so appending to one never overwrites the
+// next.
+func NewPPM(width, height int, max uint16) *PPM {
+	data, pix := newPixelGrid(width, height)
+	return &PPM{
+		data:        data,
+		pix:         pix,
+		width:       width,
+		height:      height,
+		magicNumber: "P3",
+		max:         max,
+	}
+}
+
+// NewPPMWithCapacity creates a black 8-bit P3 PPM image. It is NewPPM with a
+// max value of 255, and shares its contiguous layout.
+func NewPPMWithCapacity(width, height int) *PPM {
+	return NewPPM(width, height, 255)
+}
+
+// newPixelGrid allocates a height x width grid backed by one []Pixel, and
+// returns both the rows and the flat backing slice.
+func newPixelGrid(width, height int) ([][]Pixel, []Pixel) {
+	pixels := make([]Pixel, width*height)
+	grid := make([][]Pixel, height)
+	for y := range grid {
+		grid[y] = pixels[y*width : (y+1)*width : (y+1)*width]
+	}
+	return grid, pixels
+}
+
+// Pix returns the pixels as one flat slice in row-major order, like
+// image.RGBA.Pix: the pixel at (x, y) is Pix()[y*Stride()+x]. The slice
+// shares memory with the image, so writes through it are visible to At.
+//
+// Pix may modify the image: if an earlier operation left the rows in
+// separate allocations, it copies them into a new contiguous block and
+// switches the image over to it. Rows obtained from the image before such a
+// call then no longer alias its pixels.
+func (ppm *PPM) Pix() []Pixel {
+	if !ppm.contiguous() {
+		data, pix := newPixelGrid(ppm.width, ppm.height)
+		for y := range data {
+			copy(data[y], ppm.data[y])
+		}
+		ppm.data, ppm.pix = data, pix
+	}
+	return ppm.pix
+}
+
+// Stride returns the distance, in pixels, between vertically adjacent
+// pixels in Pix.
+func (ppm *PPM) Stride() int {
+	return ppm.width
+}
+
+// contiguous reports whether every row of data is a window of pix at its
+// row-major offset.
+func (ppm *PPM) contiguous() bool {
+	if len(ppm.pix) != ppm.width*ppm.height || len(ppm.data) != ppm.height {
+		return false
+	}
+	for y, row := range ppm.data {
+		if len(row) != ppm.width {
+			return false
+		}
+		if ppm.width > 0 && &row[0] != &ppm.pix[y*ppm.width] {
+			return false
+		}
+	}
+	return true
 }
 
 // ReadPPM reads a PPM image from a file and returns a struct that represents the image.
 func ReadPPM(filename string) (*PPM, error) {
+	return ReadPPMWithOptions(filename, ReadOptions{})
+}
+
+// ReadPPMWithOptions reads a PPM image from a file using the given options.
+func ReadPPMWithOptions(filename string, opts ReadOptions) (*PPM, error) {
+	start := time.Now()
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	return readPPM(file, opts, start)
+}
+
+// ReadPPMFrom reads a PPM image from r, such as an HTTP body or an in-memory buffer.
+func ReadPPMFrom(r io.Reader) (*PPM, error) {
+	return readPPM(r, ReadOptions{}, time.Now())
+}
 
-	reader := bufio.NewReader(file)
+// readPPM parses a PPM image from r. start is when the read began, for DecodeStats.
+func readPPM(r io.Reader, opts ReadOptions, start time.Time) (*PPM, error) {
+	counter := &countingReader{reader: r}
+	rows := 0
+	defer func() { opts.Stats.record(counter.n, rows, start) }()
+	reader := bufio.NewReader(counter)
 
 	//Magic number
-	magicNumber, err := reader.ReadString('\n')
+	var comments []string
+	magicNumber, err := readHeaderToken(reader, &comments)
 	if err != nil {
 		return nil, fmt.Errorf("error reading magic number: %v", err)
 	}
-	magicNumber = strings.TrimSpace(magicNumber)
 	if magicNumber != "P3" && magicNumber != "P6" {
 		return nil, fmt.Errorf("invalid magic number: %s", magicNumber)
 	}
 
 	//Size
-	dimensions, err := reader.ReadString('\n')
+	width, height, err := readDimensions(reader, &comments)
 	if err != nil {
 		return nil, fmt.Errorf("error reading dimensions: %v", err)
 	}
-	var width, height int
-	_, err = fmt.Sscanf(strings.TrimSpace(dimensions), "%d %d", &width, &height)
-	if err != nil {
-		return nil, fmt.Errorf("invalid dimensions: %v", err)
-	}
-	if width <= 0 || height <= 0 {
-		return nil, fmt.Errorf("invalid dimensions: width and height must be positive")
-	}
 
 	//Max value
-	maxValue, err := reader.ReadString('\n')
+	max, reader, err := readHeaderMaxValue(reader, magicNumber == "P6", width*height*3, opts, &comments)
 	if err != nil {
 		return nil, fmt.Errorf("error reading max value: %v", err)
 	}
-	maxValue = strings.TrimSpace(maxValue)
-	var max uint8
-	_, err = fmt.Sscanf(maxValue, "%d", &max)
-	if err != nil {
-		return nil, fmt.Errorf("invalid max value: %v", err)
-	}
-	data := make([][]Pixel, height)
-	expectedBytesPerPixel := 3
+	data, pix := newPixelGrid(width, height)
+	size := bytesPerSample(max)
+	expectedBytesPerPixel := 3 * size
 
 	if magicNumber == "P3" {
 		for y := 0; y < height; y++ {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				return nil, fmt.Errorf("error reading data at row %d: %v", y, err)
-			}
-			fields := strings.Fields(line)
-			rowData := make([]Pixel, width)
+			rowData := data[y]
 			for x := 0; x < width; x++ {
-				if x*3+2 >= len(fields) {
-					return nil, fmt.Errorf("index out of range at row %d, column %d", y, x)
-				}
 				var pixel Pixel
-				_, err := fmt.Sscanf(fields[x*3], "%d", &pixel.R)
-				if err != nil {
-					return nil, fmt.Errorf("error parsing Red value at row %d, column %d: %v", y, x, err)
-				}
-				_, err = fmt.Sscanf(fields[x*3+1], "%d", &pixel.G)
-				if err != nil {
-					return nil, fmt.Errorf("error parsing Green value at row %d, column %d: %v", y, x, err)
-				}
-				_, err = fmt.Sscanf(fields[x*3+2], "%d", &pixel.B)
-				if err != nil {
-					return nil, fmt.Errorf("error parsing Blue value at row %d, column %d: %v", y, x, err)
+				for i, channel := range []*uint16{&pixel.R, &pixel.G, &pixel.B} {
+					field, err := readToken(reader)
+					if err != nil {
+						return nil, fmt.Errorf("error reading data at row %d, column %d: %v", y, x, err)
+					}
+					_, err = fmt.Sscanf(field, "%d", channel)
+					if err != nil {
+						return nil, fmt.Errorf("error parsing %s value at row %d, column %d: %v", channelNames[i], y, x, err)
+					}
 				}
 				rowData[x] = pixel
 			}
-			data[y] = rowData
 		}
 	} else if magicNumber == "P6" {
 		for y := 0; y < height; y++ {
 			row := make([]byte, width*expectedBytesPerPixel)
-			n, err := reader.Read(row)
+			// io.ReadFull retries the short reads a bufio.Reader may return
+			// before the underlying stream is exhausted.
+			n, err := io.ReadFull(reader, row)
+			if err == io.EOF {
+				return nil, fmt.Errorf("unexpected end of file at row %d", y)
+			}
+			if err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("unexpected end of file at row %d, expected %d bytes, got %d", y, len(row), n)
+			}
 			if err != nil {
-				if err == io.EOF {
-					return nil, fmt.Errorf("unexpected end of file at row %d", y)
-				}
 				return nil, fmt.Errorf("error reading pixel data at row %d: %v", y, err)
 			}
-			if n < width*expectedBytesPerPixel {
-				return nil, fmt.Errorf("unexpected end of file at row %d, expected %d bytes, got %d", y, width*expectedBytesPerPixel, n)
-			}
 
-			rowData := make([]Pixel, width)
+			rowData := data[y]
 			for x := 0; x < width; x++ {
-				pixel := Pixel{R: row[x*expectedBytesPerPixel], G: row[x*expectedBytesPerPixel+1], B: row[x*expectedBytesPerPixel+2]}
+				pixel := Pixel{R: getSample(row, x*3, size), G: getSample(row, x*3+1, size), B: getSample(row, x*3+2, size)}
 				rowData[x] = pixel
 			}
-			data[y] = rowData
 		}
 	}
+	rows = len(data)
 
-	return &PPM{data, width, height, magicNumber, max}, nil
+	ppm := &PPM{data: data, pix: pix, width: width, height: height, magicNumber: magicNumber, max: max}
+	ppm.comments, ppm.metadata = splitMetadata(comments)
+	return ppm, nil
 }
 
 func (ppm *PPM) Size() (int, int) {
@@ -136,6 +217,16 @@ func (ppm *PPM) At(x, y int) Pixel {
 	return ppm.data[y][x]
 }
 
+// AtOK returns the pixel at column x and row y and true, or the zero Pixel
+// and false if the coordinates are outside the image. Unlike At, it never
+// panics.
+func (ppm *PPM) AtOK(x, y int) (Pixel, bool) {
+	if x < 0 || x >= ppm.width || y < 0 || y >= ppm.height {
+		return Pixel{}, false
+	}
+	return ppm.data[y][x], true
+}
+
 func (ppm *PPM) Set(x, y int, value Pixel) {
 	if x < 0 || x >= ppm.width || y < 0 || y >= ppm.height {
 		panic("Index out of bounds")
@@ -145,30 +236,72 @@ func (ppm *PPM) Set(x, y int, value Pixel) {
 }
 
 func (ppm *PPM) Save(filename string) error {
+	return ppm.SaveWithOptions(filename, SaveOptions{})
+}
+
+// SaveWithOptions saves the PPM image to a file using the given options.
+func (ppm *PPM) SaveWithOptions(filename string, opts SaveOptions) error {
 	file, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
+	_, err = ppm.writeTo(file, opts)
+	return err
+}
+
+// WriteTo writes the PPM image to w in its current format and returns the
+// number of bytes written. It implements io.WriterTo.
+func (ppm *PPM) WriteTo(w io.Writer) (int64, error) {
+	return ppm.writeTo(w, SaveOptions{})
+}
+
+func (ppm *PPM) writeTo(w io.Writer, opts SaveOptions) (int64, error) {
+	return writeBuffered(w, func(writer *bufio.Writer) error {
+		return ppm.encode(writer, opts)
+	})
+}
+
+// encode writes the header and pixel data to file.
+func (ppm *PPM) encode(file *bufio.Writer, opts SaveOptions) error {
+	var err error
 	if ppm.magicNumber == "P6" || ppm.magicNumber == "P3" {
-		fmt.Fprintf(file, "%s\n%d %d\n%d\n", ppm.magicNumber, ppm.width, ppm.height, ppm.max)
+		fmt.Fprintf(file, "%s\n", ppm.magicNumber)
+		err = writeComments(file, ppm.comments, ppm.metadata, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(file, "%d %d\n%d\n", ppm.width, ppm.height, ppm.max)
 	} else {
 		err = fmt.Errorf("magic number error")
 		return err
 	}
 
+	if ppm.magicNumber == "P6" {
+		size := bytesPerSample(ppm.max)
+		payload := packRows(ppm.height, ppm.width*3*size, func(y int, row []byte) {
+			for x := 0; x < ppm.width; x++ {
+				pixel := ppm.data[y][x]
+				putSample(row, x*3, size, pixel.R)
+				putSample(row, x*3+1, size, pixel.G)
+				putSample(row, x*3+2, size, pixel.B)
+			}
+		})
+		_, err = file.Write(payload)
+		if err != nil {
+			return fmt.Errorf("error writing pixel data: %v", err)
+		}
+		return nil
+	}
+
+	format := sampleFormat(ppm.max, opts)
+	format = format + " " + format + " " + format + " "
 	for y := 0; y < ppm.height; y++ {
 		for x := 0; x < ppm.width; x++ {
 			pixel := ppm.data[y][x]
-			if ppm.magicNumber == "P6" {
-				file.Write([]byte{pixel.R, pixel.G, pixel.B})
-			} else if ppm.magicNumber == "P3" {
-				fmt.Fprintf(file, "%d %d %d ", pixel.R, pixel.G, pixel.B)
-			}
-		}
-		if ppm.magicNumber == "P3" {
-			fmt.Fprint(file, "\n")
+			fmt.Fprintf(file, format, pixel.R, pixel.G, pixel.B)
 		}
+		fmt.Fprint(file, "\n")
 	}
 
 	return nil
@@ -178,9 +311,9 @@ func (ppm *PPM) Invert() {
 	for y := 0; y < ppm.height; y++ {
 		for x := 0; x < ppm.width; x++ {
 			pixel := &ppm.data[y][x]
-			pixel.R = 255 - pixel.R
-			pixel.G = 255 - pixel.G
-			pixel.B = 255 - pixel.B
+			pixel.R = ppm.max - pixel.R
+			pixel.G = ppm.max - pixel.G
+			pixel.B = ppm.max - pixel.B
 		}
 	}
 }
@@ -203,12 +336,56 @@ func (ppm *PPM) SetMagicNumber(magicNumber string) {
 	ppm.magicNumber = magicNumber
 }
 
-func (ppm *PPM) SetMaxValue(maxValue uint8) {
+// AddComment adds a comment line written to the header on Save.
+func (ppm *PPM) AddComment(comment string) {
+	ppm.comments = append(ppm.comments, comment)
+}
+
+// SetMetadata stores a key/value pair that is written to the header as a
+// "# key: value" comment and read back into the metadata on load. Keys are a
+// single word of letters, digits, '-', '_' or '.'; values must fit on one
+// line.
+func (ppm *PPM) SetMetadata(key, value string) error {
+	return setMetadata(&ppm.metadata, key, value)
+}
+
+// GetMetadata returns the metadata value stored under key.
+func (ppm *PPM) GetMetadata(key string) (string, bool) {
+	value, ok := ppm.metadata[key]
+	return value, ok
+}
+
+// SetResolution records the physical resolution in dots per inch, stored as
+// "dpi" metadata since Netpbm has no native field for it.
+func (ppm *PPM) SetResolution(dpiX, dpiY float64) error {
+	return setResolution(&ppm.metadata, dpiX, dpiY)
+}
+
+// Resolution returns the horizontal and vertical resolution in dots per inch,
+// or zeros when none is recorded.
+func (ppm *PPM) Resolution() (float64, float64) {
+	return resolution(ppm.metadata)
+}
+
+// PhysicalSize returns the printed width and height in inches, or zeros when
+// no resolution is recorded.
+func (ppm *PPM) PhysicalSize() (float64, float64) {
+	return physicalSize(ppm.width, ppm.height, ppm.metadata)
+}
+
+// SetMaxValue sets the maximum sample value of the PPM image, rescaling every
+// sample to the new range with rounding. A max value of 0 is rejected and
+// leaves the image unchanged.
+func (ppm *PPM) SetMaxValue(maxValue uint16) {
+	if maxValue == 0 {
+		return
+	}
 	for y := 0; y < ppm.height; y++ {
 		for x := 0; x < ppm.width; x++ {
-			ppm.data[y][x].R = uint8(float64(ppm.data[y][x].R) * float64(maxValue) / float64(ppm.max))
-			ppm.data[y][x].G = uint8(float64(ppm.data[y][x].G) * float64(maxValue) / float64(ppm.max))
-			ppm.data[y][x].B = uint8(float64(ppm.data[y][x].B) * float64(maxValue) / float64(ppm.max))
+			pixel := &ppm.data[y][x]
+			pixel.R = rescaleSample(pixel.R, ppm.max, maxValue)
+			pixel.G = rescaleSample(pixel.G, ppm.max, maxValue)
+			pixel.B = rescaleSample(pixel.B, ppm.max, maxValue)
 		}
 	}
 
@@ -216,16 +393,16 @@ func (ppm *PPM) SetMaxValue(maxValue uint8) {
 }
 
 func (ppm *PPM) Rotate90CW() {
+	data, pix := newPixelGrid(ppm.height, ppm.width)
 	newPPM := PPM{
-		data:        make([][]Pixel, ppm.width),
+		data:        data,
+		pix:         pix,
 		width:       ppm.height,
 		height:      ppm.width,
 		magicNumber: ppm.magicNumber,
 		max:         ppm.max,
-	}
-
-	for i := range newPPM.data {
-		newPPM.data[i] = make([]Pixel, newPPM.width)
+		comments:    ppm.comments,
+		metadata:    ppm.metadata,
 	}
 
 	for y := 0; y < ppm.height; y++ {
@@ -237,58 +414,152 @@ func (ppm *PPM) Rotate90CW() {
 	*ppm = newPPM
 }
 
-func (ppm *PPM) ToPGM() *PGM {
-	pgm := &PGM{
-		width:       ppm.width,
-		height:      ppm.height,
-		magicNumber: "P2",
-		max:         ppm.max,
+// Rotate90CCW rotates the PPM image 90 degrees counterclockwise.
+func (ppm *PPM) Rotate90CCW() {
+	if ppm.width <= 0 || ppm.height <= 0 {
+		return
 	}
 
-	pgm.data = make([][]uint8, ppm.height)
-	for i := range pgm.data {
-		pgm.data[i] = make([]uint8, ppm.width)
+	newData, pix := newPixelGrid(ppm.height, ppm.width)
+	for i := 0; i < ppm.width; i++ {
+		for j := 0; j < ppm.height; j++ {
+			newData[ppm.width-1-i][j] = ppm.data[j][i]
+		}
 	}
+	ppm.data, ppm.pix = newData, pix
+	ppm.width, ppm.height = ppm.height, ppm.width
+}
 
-	for y := 0; y < ppm.height; y++ {
-		for x := 0; x < ppm.width; x++ {
-			gray := uint8((int(ppm.data[y][x].R) + int(ppm.data[y][x].G) + int(ppm.data[y][x].B)) / 3)
-			pgm.data[y][x] = gray
+// Rotate270CW rotates the PPM image 270 degrees clockwise. It is the same as
+// Rotate90CCW.
+func (ppm *PPM) Rotate270CW() {
+	ppm.Rotate90CCW()
+}
+
+// Rotate180 rotates the PPM image 180 degrees in place.
+func (ppm *PPM) Rotate180() {
+	ppm.Flip()
+	ppm.Flop()
+}
+
+// Rotate rotates the image clockwise by angle degrees about its center. The
+// image grows to contain the rotated bounds; each pixel takes the nearest
+// source pixel, and pixels with no source are filled with bg.
+func (ppm *PPM) Rotate(angle float64, bg Pixel) {
+	ppm.RotateInterpolated(angle, bg, NearestNeighbor)
+}
+
+// RotateInterpolated is Rotate with a choice of interpolation. A pixel is
+// filled with bg when its source position lies outside the image. Exact
+// multiples of 90 degrees use the lossless quarter-turn rotations instead.
+func (ppm *PPM) RotateInterpolated(angle float64, bg Pixel, interp Interpolation) {
+	if turns, ok := quarterTurns(angle); ok {
+		// Exact quarter turns need no resampling.
+		switch turns {
+		case 1:
+			ppm.Rotate90CW()
+		case 2:
+			ppm.Rotate180()
+		case 3:
+			ppm.Rotate270CW()
+		}
+		return
+	}
+	ppm.rotateResampled(angle, bg, interp)
+}
+
+// rotateResampled is the general path of RotateInterpolated: each output
+// pixel is mapped back to its source position and interpolated there.
+func (ppm *PPM) rotateResampled(angle float64, bg Pixel, interp Interpolation) {
+	newWidth, newHeight, source := rotation(ppm.width, ppm.height, angle)
+	data, pix := newPixelGrid(newWidth, newHeight)
+	top := float64(ppm.max)
+	channel := func(fx, fy float64, get func(Pixel) uint16) uint16 {
+		v := interpolate(fx, fy, ppm.width, ppm.height, interp, func(x, y int) float64 {
+			return float64(get(ppm.data[y][x]))
+		})
+		return uint16(math.Round(math.Max(0, math.Min(v, top))))
+	}
+	for y := range data {
+		for x := range data[y] {
+			fx, fy := source(x, y)
+			sx, sy := int(math.Round(fx)), int(math.Round(fy))
+			if sx < 0 || sx >= ppm.width || sy < 0 || sy >= ppm.height {
+				data[y][x] = bg
+				continue
+			}
+			data[y][x] = Pixel{
+				R: channel(fx, fy, func(p Pixel) uint16 { return p.R }),
+				G: channel(fx, fy, func(p Pixel) uint16 { return p.G }),
+				B: channel(fx, fy, func(p Pixel) uint16 { return p.B }),
+			}
 		}
 	}
+	ppm.data, ppm.pix = data, pix
+	ppm.width, ppm.height = newWidth, newHeight
+}
 
+// ToPGM converts the image to grayscale by averaging R, G and B.
+func (ppm *PPM) ToPGM() *PGM {
+	pgm, _ := ppm.ToPGMWeighted("average")
 	return pgm
 }
 
+// grayWeights maps the ToPGMWeighted modes to their R, G and B weights.
+var grayWeights = map[string][3]float64{
+	"rec601": {0.299, 0.587, 0.114},
+	"rec709": {0.2126, 0.7152, 0.0722},
+}
+
+// ToPGMWeighted converts the image to a P2 grayscale image with the given
+// channel weighting: "average" (equal weights), "rec601" (SDTV luma, as in
+// PGMFromImage) or "rec709" (HDTV luma). The average truncates like ToPGM
+// always has; the weighted sums are rounded to the nearest integer.
+func (ppm *PPM) ToPGMWeighted(mode string) (*PGM, error) {
+	weights, ok := grayWeights[mode]
+	if !ok && mode != "average" {
+		return nil, fmt.Errorf("unknown grayscale mode %q", mode)
+	}
+	pgm := NewPGM(ppm.width, ppm.height, ppm.max)
+	for y := 0; y < ppm.height; y++ {
+		for x := 0; x < ppm.width; x++ {
+			pixel := ppm.data[y][x]
+			if !ok {
+				pgm.data[y][x] = uint16((int(pixel.R) + int(pixel.G) + int(pixel.B)) / 3)
+				continue
+			}
+			gray := weights[0]*float64(pixel.R) + weights[1]*float64(pixel.G) + weights[2]*float64(pixel.B)
+			pgm.data[y][x] = uint16(math.Min(math.Round(gray), float64(ppm.max)))
+		}
+	}
+	return pgm, nil
+}
+
 type Point struct {
 	X, Y int
 }
 
-func rgbToGray(color Pixel) uint8 {
+func rgbToGray(color Pixel) uint16 {
 
-	return uint8(0.299*float64(color.R) + 0.587*float64(color.G) + 0.114*float64(color.B))
+	return uint16(0.299*float64(color.R) + 0.587*float64(color.G) + 0.114*float64(color.B))
 }
 
+// ToPBM converts the PPM image to a PBM image at the midpoint threshold; it
+// is ToPBMThreshold(128).
 func (ppm *PPM) ToPBM() *PBM {
-	pbm := &PBM{
-		width:       ppm.width,
-		height:      ppm.height,
-		magicNumber: "P1",
-	}
-
-	pbm.data = make([][]bool, ppm.height)
-	for i := range pbm.data {
-		pbm.data[i] = make([]bool, ppm.width)
-	}
+	return ppm.ToPBMThreshold(128)
+}
 
-	threshold := uint8(ppm.max / 2)
+// ToPBMThreshold converts the PPM image to a PBM image. A pixel is set where
+// its Rec. 601 luminance, scaled to 0-255, is at least threshold, so a
+// threshold of 0 sets every pixel.
+func (ppm *PPM) ToPBMThreshold(threshold uint8) *PBM {
+	pbm := NewPBM(ppm.width, ppm.height)
 	for y := 0; y < ppm.height; y++ {
 		for x := 0; x < ppm.width; x++ {
-			average := (uint16(ppm.data[y][x].R) + uint16(ppm.data[y][x].G) + uint16(ppm.data[y][x].B)) / 3
-			pbm.data[y][x] = average > uint16(threshold)
+			pbm.data[y][x] = scaleTo8(rgbToGray(ppm.data[y][x]), ppm.max) >= threshold
 		}
 	}
-
 	return pbm
 }
 
@@ -342,6 +613,144 @@ func (ppm *PPM) DrawLine(p1, p2 Point, color Pixel) {
 	}
 }
 
+// DrawQuadraticBezier draws the quadratic Bézier curve from p0 to p2 with
+// control point p1.
+func (ppm *PPM) DrawQuadraticBezier(p0, p1, p2 Point, color Pixel) {
+	ppm.drawBezier([]Point{p0, p1, p2}, color)
+}
+
+// DrawCubicBezier draws the cubic Bézier curve from p0 to p3 with control
+// points p1 and p2.
+func (ppm *PPM) DrawCubicBezier(p0, p1, p2, p3 Point, color Pixel) {
+	ppm.drawBezier([]Point{p0, p1, p2, p3}, color)
+}
+
+// drawBezier samples the Bézier curve with the given control points and joins
+// successive samples with DrawLine. The curve is never longer than its control
+// polygon, so taking one step per pixel of that length keeps every segment
+// about a pixel long. The first and last samples are the endpoints exactly.
+func (ppm *PPM) drawBezier(control []Point, color Pixel) {
+	span := 0.0
+	for i := 1; i < len(control); i++ {
+		span += math.Hypot(float64(control[i].X-control[i-1].X), float64(control[i].Y-control[i-1].Y))
+	}
+	steps := max(int(math.Ceil(span)), 1)
+
+	points := make([]float64, 2*len(control))
+	prev := control[0]
+	for i := 1; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		// De Casteljau: repeatedly interpolate between neighbours.
+		for j, p := range control {
+			points[2*j], points[2*j+1] = float64(p.X), float64(p.Y)
+		}
+		for n := len(control) - 1; n > 0; n-- {
+			for j := 0; j < n; j++ {
+				points[2*j] += (points[2*j+2] - points[2*j]) * t
+				points[2*j+1] += (points[2*j+3] - points[2*j+1]) * t
+			}
+		}
+		next := Point{int(math.Round(points[0])), int(math.Round(points[1]))}
+		if i == steps {
+			next = control[len(control)-1]
+		}
+		ppm.DrawLine(prev, next, color)
+		prev = next
+	}
+}
+
+// DrawThickLine draws a line thickness pixels wide between p1 and p2 with
+// square (butt) ends. It fills the rectangle around the segment: a pixel is
+// set when it projects onto the segment and its signed perpendicular distance
+// d satisfies -thickness/2 <= d < thickness/2, so horizontal and vertical
+// lines are exactly thickness pixels across. A thickness of 1 draws a plain
+// DrawLine, and a thickness of 0 or less draws nothing.
+func (ppm *PPM) DrawThickLine(p1, p2 Point, thickness int, color Pixel) {
+	if thickness <= 0 {
+		return
+	}
+	if thickness == 1 {
+		ppm.DrawLine(p1, p2, color)
+		return
+	}
+	dx, dy := float64(p2.X-p1.X), float64(p2.Y-p1.Y)
+	length := math.Hypot(dx, dy)
+	// A single point has no direction; treat it as horizontal so it
+	// draws as a one-pixel-long bar.
+	ux, uy := 1.0, 0.0
+	if length > 0 {
+		ux, uy = dx/length, dy/length
+	}
+	half := float64(thickness) / 2
+
+	minX := int(math.Floor(math.Min(float64(p1.X), float64(p2.X)) - half))
+	maxX := int(math.Ceil(math.Max(float64(p1.X), float64(p2.X)) + half))
+	minY := int(math.Floor(math.Min(float64(p1.Y), float64(p2.Y)) - half))
+	maxY := int(math.Ceil(math.Max(float64(p1.Y), float64(p2.Y)) + half))
+	for y := max(minY, 0); y <= min(maxY, ppm.height-1); y++ {
+		for x := max(minX, 0); x <= min(maxX, ppm.width-1); x++ {
+			px, py := float64(x-p1.X), float64(y-p1.Y)
+			along := px*ux + py*uy
+			across := py*ux - px*uy
+			if along >= -1e-9 && along <= length+1e-9 && across >= -half && across < half {
+				ppm.data[y][x] = color
+			}
+		}
+	}
+}
+
+// DrawLineAA draws an anti-aliased line with Xiaolin Wu's algorithm. Along
+// the major axis, each step covers two pixels whose shares of the line are
+// blended toward color from the existing background. The endpoints are
+// drawn at full intensity.
+func (ppm *PPM) DrawLineAA(p1, p2 Point, color Pixel) {
+	x1, y1, x2, y2 := p1.X, p1.Y, p2.X, p2.Y
+	steep := DrawLinetool(y2-y1) > DrawLinetool(x2-x1)
+	if steep {
+		x1, y1, x2, y2 = y1, x1, y2, x2
+	}
+	if x1 > x2 {
+		x1, y1, x2, y2 = x2, y2, x1, y1
+	}
+	plot := func(x, y int, coverage float64) {
+		if steep {
+			x, y = y, x
+		}
+		ppm.SetPixelBlend(Point{x, y}, color, coverage)
+	}
+
+	gradient := 0.0
+	if x2 != x1 {
+		gradient = float64(y2-y1) / float64(x2-x1)
+	}
+	for x := x1; x <= x2; x++ {
+		intery := float64(y1) + gradient*float64(x-x1)
+		base := math.Floor(intery)
+		frac := intery - base
+		plot(x, int(base), 1-frac)
+		if frac > 0 {
+			plot(x, int(base)+1, frac)
+		}
+	}
+}
+
+// SetPixelBlend moves the pixel at p toward color by alpha, clamped to
+// [0, 1]: 0 leaves it unchanged and 1 replaces it. Points outside the image
+// are ignored.
+func (ppm *PPM) SetPixelBlend(p Point, color Pixel, alpha float64) {
+	if p.X < 0 || p.X >= ppm.width || p.Y < 0 || p.Y >= ppm.height {
+		return
+	}
+	alpha = math.Max(0, math.Min(alpha, 1))
+	mix := func(from, to uint16) uint16 {
+		return uint16(math.Round(float64(from) + (float64(to)-float64(from))*alpha))
+	}
+	pixel := &ppm.data[p.Y][p.X]
+	pixel.R = mix(pixel.R, color.R)
+	pixel.G = mix(pixel.G, color.G)
+	pixel.B = mix(pixel.B, color.B)
+}
+
 func DrawLinetool(x int) int {
 	if x < 0 {
 		return -x
@@ -392,69 +801,195 @@ func (ppm *PPM) DrawRectangle(p1 Point, width, height int, color Pixel) {
 	ppm.DrawLine(p3, p1, color)
 }
 
+// DrawFilledRectangle fills the width x height rectangle whose top-left corner
+// is p1, covering [p1.X, p1.X+width) x [p1.Y, p1.Y+height) clipped to the image.
 func (ppm *PPM) DrawFilledRectangle(p1 Point, width, height int, color Pixel) {
-	if p1.Y+height < ppm.height {
-		for y := p1.Y; y < p1.Y+height; y++ {
-			if p1.X+width < ppm.width {
-				for x := p1.X; x <= p1.X+width; x++ {
-					ppm.data[y][x] = color
-				}
-			} else if p1.X+width > ppm.width {
-				for x := p1.X; x < ppm.width; x++ {
-					ppm.data[y][x] = color
-				}
-			}
+	for y := max(0, p1.Y); y < min(ppm.height, p1.Y+height); y++ {
+		for x := max(0, p1.X); x < min(ppm.width, p1.X+width); x++ {
+			ppm.data[y][x] = color
 		}
-	} else if p1.Y+height > ppm.height {
-		for y := p1.Y; y < ppm.height; y++ {
-			if p1.X+width < ppm.width {
-				for x := p1.X; x <= p1.X+width; x++ {
-					ppm.data[y][x] = color
-				}
-			} else if p1.X+width > ppm.width {
-				for x := p1.X; x < ppm.width; x++ {
-					ppm.data[y][x] = color
-				}
-			}
+	}
+}
+
+// FillRect fills [r.Min.X, r.Max.X) x [r.Min.Y, r.Max.Y) with color, clipped
+// to the image bounds. Like the image package, Max is exclusive.
+func (ppm *PPM) FillRect(r image.Rectangle, color Pixel) {
+	r = r.Intersect(image.Rect(0, 0, ppm.width, ppm.height))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			ppm.data[y][x] = color
 		}
 	}
 }
 
+// DrawCircle draws the outline of a circle of the given radius with the
+// midpoint circle algorithm, producing a connected one-pixel outline.
 func (ppm *PPM) DrawCircle(center Point, radius int, color Pixel) {
-	for y := 0; y < ppm.height; y++ {
-		for x := 0; x < ppm.width; x++ {
-			dx := float64(x - center.X)
-			dy := float64(y - center.Y)
-			distance := math.Sqrt(dx*dx + dy*dy)
-			if math.Abs(distance-float64(radius)*0.85) < 0.5 {
-				ppm.data[y][x] = color
+	midpointCircle(radius, func(x, y int) {
+		ppm.SetPixel(Point{center.X + x, center.Y + y}, color)
+		ppm.SetPixel(Point{center.X - x, center.Y + y}, color)
+		ppm.SetPixel(Point{center.X + x, center.Y - y}, color)
+		ppm.SetPixel(Point{center.X - x, center.Y - y}, color)
+		ppm.SetPixel(Point{center.X + y, center.Y + x}, color)
+		ppm.SetPixel(Point{center.X - y, center.Y + x}, color)
+		ppm.SetPixel(Point{center.X + y, center.Y - x}, color)
+		ppm.SetPixel(Point{center.X - y, center.Y - x}, color)
+	})
+}
+
+// DrawFilledCircle fills the disc bounded by DrawCircle's outline.
+func (ppm *PPM) DrawFilledCircle(center Point, radius int, color Pixel) {
+	midpointCircle(radius, func(x, y int) {
+		ppm.drawSpan(center.X-x, center.X+x, center.Y+y, color)
+		ppm.drawSpan(center.X-x, center.X+x, center.Y-y, color)
+		ppm.drawSpan(center.X-y, center.X+y, center.Y+x, color)
+		ppm.drawSpan(center.X-y, center.X+y, center.Y-x, color)
+	})
+}
+
+// midpointCircle calls plot with the offsets of one octant of a circle of
+// the given radius, from (radius, 0) to the diagonal.
+func midpointCircle(radius int, plot func(x, y int)) {
+	if radius < 0 {
+		return
+	}
+	x, y := radius, 0
+	err := 1 - radius
+	for x >= y {
+		plot(x, y)
+		y++
+		if err < 0 {
+			err += 2*y + 1
+		} else {
+			x--
+			err += 2*(y-x) + 1
+		}
+	}
+}
+
+// DrawEllipse draws the outline of an axis-aligned ellipse with horizontal
+// radius rx and vertical radius ry using the midpoint ellipse algorithm.
+func (ppm *PPM) DrawEllipse(center Point, rx, ry int, color Pixel) {
+	midpointEllipse(rx, ry, func(x, y int) {
+		ppm.SetPixel(Point{center.X + x, center.Y + y}, color)
+		ppm.SetPixel(Point{center.X - x, center.Y + y}, color)
+		ppm.SetPixel(Point{center.X + x, center.Y - y}, color)
+		ppm.SetPixel(Point{center.X - x, center.Y - y}, color)
+	})
+}
+
+// DrawFilledEllipse fills the region bounded by DrawEllipse's outline.
+func (ppm *PPM) DrawFilledEllipse(center Point, rx, ry int, color Pixel) {
+	midpointEllipse(rx, ry, func(x, y int) {
+		ppm.drawSpan(center.X-x, center.X+x, center.Y+y, color)
+		ppm.drawSpan(center.X-x, center.X+x, center.Y-y, color)
+	})
+}
+
+// midpointEllipse calls plot with the offsets of one quadrant of an ellipse
+// with radii rx and ry, from (0, ry) to (rx, 0).
+func midpointEllipse(rx, ry int, plot func(x, y int)) {
+	if rx < 0 || ry < 0 {
+		return
+	}
+	if rx == 0 || ry == 0 {
+		// Degenerate ellipse: a straight segment along one axis.
+		for x := 0; x <= rx; x++ {
+			for y := 0; y <= ry; y++ {
+				plot(x, y)
 			}
 		}
+		return
+	}
+	rx2, ry2 := float64(rx)*float64(rx), float64(ry)*float64(ry)
+	x, y := 0, ry
+	px, py := 0.0, 2*rx2*float64(y)
+
+	// Region 1: the slope is shallower than -1, so step along x.
+	p := ry2 - rx2*float64(ry) + rx2/4
+	for px < py {
+		plot(x, y)
+		x++
+		px += 2 * ry2
+		if p < 0 {
+			p += ry2 + px
+		} else {
+			y--
+			py -= 2 * rx2
+			p += ry2 + px - py
+		}
+	}
+
+	// Region 2: the slope is steeper than -1, so step along y.
+	fx, fy := float64(x)+0.5, float64(y-1)
+	p = ry2*fx*fx + rx2*fy*fy - rx2*ry2
+	for y >= 0 {
+		plot(x, y)
+		y--
+		py -= 2 * rx2
+		if p > 0 {
+			p += rx2 - py
+		} else {
+			x++
+			px += 2 * ry2
+			p += rx2 - py + px
+		}
 	}
 }
 
-func (ppm *PPM) DrawFilledCircle(center Point, radius int, color Pixel) {
-	for radius >= 0 {
-		ppm.DrawCircle(center, radius, color)
-		radius--
+// drawSpan sets the pixels from x1 to x2 inclusive on row y, clipped to the image.
+func (ppm *PPM) drawSpan(x1, x2, y int, color Pixel) {
+	if y < 0 || y >= ppm.height {
+		return
+	}
+	for x := max(0, x1); x <= min(ppm.width-1, x2); x++ {
+		ppm.data[y][x] = color
 	}
 }
 
+// DrawFilledPolygon fills the polygon with the even-odd rule and draws its
+// outline, so concave shapes fill correctly and pixels that already had the
+// fill color do not affect the result. Vertices are pixel positions, as in
+// DrawPolygon.
 func (ppm *PPM) DrawFilledPolygon(points []Point, color Pixel) {
+	fillScanlines(ppm.width, ppm.height, points, 0, func(x, y int) {
+		ppm.data[y][x] = color
+	})
 	ppm.DrawPolygon(points, color)
-	for i := 0; i < ppm.height; i++ {
-		var positions []int
-		var number_points int
-		for j := 0; j < ppm.width; j++ {
-			if ppm.data[i][j] == color {
-				number_points += 1
-				positions = append(positions, j)
+}
+
+// FillScanlines calls set for every pixel of a width x height grid whose center
+// lies inside polygon, using the even-odd rule. It works for concave and
+// self-intersecting polygons and can drive fills on any image type.
+func FillScanlines(width, height int, polygon []Point, set func(x, y int)) {
+	fillScanlines(width, height, polygon, 0.5, set)
+}
+
+// fillScanlines is FillScanlines sampling each pixel at (x+offset, y+offset)
+// instead of its center. An offset of 0 treats the vertices as pixel
+// indices, matching the outline drawn by DrawPolygon.
+func fillScanlines(width, height int, polygon []Point, offset float64, set func(x, y int)) {
+	if len(polygon) < 3 {
+		return
+	}
+	var crossings []float64
+	for y := 0; y < height; y++ {
+		center := float64(y) + offset
+		crossings = crossings[:0]
+		for i := range polygon {
+			p1, p2 := polygon[i], polygon[(i+1)%len(polygon)]
+			if (float64(p1.Y) <= center) == (float64(p2.Y) <= center) {
+				continue
 			}
+			t := (center - float64(p1.Y)) / float64(p2.Y-p1.Y)
+			crossings = append(crossings, float64(p1.X)+t*float64(p2.X-p1.X))
 		}
-		if number_points > 1 {
-			for k := positions[0] + 1; k < positions[len(positions)-1]; k++ {
-				ppm.data[i][k] = color
-
+		sort.Float64s(crossings)
+		for i := 0; i+1 < len(crossings); i += 2 {
+			start := int(math.Ceil(crossings[i] - offset))
+			end := int(math.Ceil(crossings[i+1] - offset))
+			for x := max(start, 0); x < min(end, width); x++ {
+				set(x, y)
 			}
 		}
 	}
@@ -462,49 +997,72 @@ func (ppm *PPM) DrawFilledPolygon(points []Point, color Pixel) {
 
 // Bonus
 
+// MaxFractalDepth caps the recursion depth of the fractal drawing methods.
+// Each extra level multiplies the work (by 4 for Koch, by 3 for Sierpinski),
+// so a larger n is clamped to this value instead of hanging the caller.
+var MaxFractalDepth = 8
+
+// clampFractalDepth bounds n to [0, MaxFractalDepth].
+func clampFractalDepth(n int) int {
+	if n < 0 {
+		return 0
+	}
+	if n > MaxFractalDepth {
+		return MaxFractalDepth
+	}
+	return n
+}
+
 // KochSnowflake
-func (ppm *PPM) DrawKochSnowflake(n int, start Point, size int, color Pixel) {
-	height := int(math.Sqrt(3) * float64(size) / 2)
-	point1 := start
-	point2 := Point{X: start.X + size, Y: start.Y}
-	point3 := Point{X: start.X + size/2, Y: start.Y + height}
 
-	ppm.KochSnowflake(n, point1, point2, color)
-	ppm.KochSnowflake(n, point2, point3, color)
-	ppm.KochSnowflake(n, point3, point1, color)
+// DrawKochSnowflake draws a Koch snowflake of depth n, clamped to MaxFractalDepth.
+func (ppm *PPM) DrawKochSnowflake(n int, start Point, size int, color Pixel) {
+	n = clampFractalDepth(n)
+	height := math.Sqrt(3) * float64(size) / 2
+	x1, y1 := float64(start.X), float64(start.Y)
+	x2, y2 := x1+float64(size), y1
+	x3, y3 := x1+float64(size)/2, y1+height
+
+	ppm.kochTools(n, x1, y1, x2, y2, color)
+	ppm.kochTools(n, x2, y2, x3, y3, color)
+	ppm.kochTools(n, x3, y3, x1, y1, color)
 }
 
+// KochSnowflake draws one Koch curve of depth n, clamped to MaxFractalDepth, between two points.
 func (ppm *PPM) KochSnowflake(n int, point1, point2 Point, color Pixel) {
+	n = clampFractalDepth(n)
+	ppm.kochTools(n, float64(point1.X), float64(point1.Y), float64(point2.X), float64(point2.Y), color)
+}
+
+// kochTools recurses in floating point so that segments keep meeting exactly,
+// and only rounds to pixel coordinates when drawing the final segments.
+func (ppm *PPM) kochTools(n int, x1, y1, x2, y2 float64, color Pixel) {
 	if n == 0 {
-		ppm.DrawLine(point1, point2, color)
-	} else {
-		p_1 := Point{
-			X: point1.X + (point2.X-point1.X)/3,
-			Y: point1.Y + (point2.Y-point1.Y)/3,
-		}
-		p_2 := Point{
-			X: point1.X + 2*(point2.X-point1.X)/3,
-			Y: point1.Y + 2*(point2.Y-point1.Y)/3,
-		}
+		ppm.DrawLine(Point{int(math.Round(x1)), int(math.Round(y1))}, Point{int(math.Round(x2)), int(math.Round(y2))}, color)
+		return
+	}
 
-		angle := math.Pi / 3
-		cos := math.Cos(angle)
-		sin := math.Sin(angle)
+	ax, ay := x1+(x2-x1)/3, y1+(y2-y1)/3
+	bx, by := x1+2*(x2-x1)/3, y1+2*(y2-y1)/3
 
-		p3 := Point{
-			X: int(float64(p_1.X-p_2.X)*cos-float64(p_1.Y-p_2.Y)*sin) + p_2.X,
-			Y: int(float64(p_1.X-p_2.X)*sin+float64(p_1.Y-p_2.Y)*cos) + p_2.Y,
-		}
+	angle := math.Pi / 3
+	cos := math.Cos(angle)
+	sin := math.Sin(angle)
 
-		ppm.KochSnowflake(n-1, point1, p_1, color)
-		ppm.KochSnowflake(n-1, p_1, p3, color)
-		ppm.KochSnowflake(n-1, p3, p_2, color)
-		ppm.KochSnowflake(n-1, p_2, point2, color)
-	}
+	cx := (ax-bx)*cos - (ay-by)*sin + bx
+	cy := (ax-bx)*sin + (ay-by)*cos + by
+
+	ppm.kochTools(n-1, x1, y1, ax, ay, color)
+	ppm.kochTools(n-1, ax, ay, cx, cy, color)
+	ppm.kochTools(n-1, cx, cy, bx, by, color)
+	ppm.kochTools(n-1, bx, by, x2, y2, color)
 }
 
 // Sierpinski
+
+// DrawSierpinskiTriangle draws a Sierpinski triangle of depth n, clamped to MaxFractalDepth.
 func (ppm *PPM) DrawSierpinskiTriangle(n int, start Point, width int, color Pixel) {
+	n = clampFractalDepth(n)
 
 	height := int(math.Sqrt(3) * float64(width) / 2)
 	p1 := start
@@ -550,9 +1108,9 @@ func perlinNoiseTools(x, y float64) float64 {
 }
 
 func intColors(color1 Pixel, color2 Pixel, t float64) Pixel {
-	r := uint8(float64(color1.R)*(1-t) + float64(color2.R)*t)
-	g := uint8(float64(color1.G)*(1-t) + float64(color2.G)*t)
-	b := uint8(float64(color1.B)*(1-t) + float64(color2.B)*t)
+	r := uint16(float64(color1.R)*(1-t) + float64(color2.R)*t)
+	g := uint16(float64(color1.G)*(1-t) + float64(color2.G)*t)
+	b := uint16(float64(color1.B)*(1-t) + float64(color2.B)*t)
 
 	return Pixel{R: r, G: g, B: b}
 }
@@ -607,9 +1165,1008 @@ func (ppm *PPM) averageColors(pixels []Pixel) Pixel {
 		totalG += int(pixel.G)
 		totalB += int(pixel.B)
 	}
-	avgR := uint8(totalR / count)
-	avgG := uint8(totalG / count)
-	avgB := uint8(totalB / count)
+	avgR := uint16(totalR / count)
+	avgG := uint16(totalG / count)
+	avgB := uint16(totalB / count)
 
 	return Pixel{R: avgR, G: avgG, B: avgB}
 }
+
+// SampleBilinear returns the color at the fractional coordinates (fx, fy),
+// bilinearly interpolated between the four surrounding pixels.
+// Coordinates outside the image are clamped to the nearest edge.
+func (ppm *PPM) SampleBilinear(fx, fy float64) Pixel {
+	if ppm.width <= 0 || ppm.height <= 0 {
+		return Pixel{}
+	}
+	fx = math.Max(0, math.Min(fx, float64(ppm.width-1)))
+	fy = math.Max(0, math.Min(fy, float64(ppm.height-1)))
+
+	x0, y0 := int(fx), int(fy)
+	x1, y1 := x0+1, y0+1
+	if x1 >= ppm.width {
+		x1 = ppm.width - 1
+	}
+	if y1 >= ppm.height {
+		y1 = ppm.height - 1
+	}
+	tx, ty := fx-float64(x0), fy-float64(y0)
+
+	lerp := func(a, b, c, d uint16) uint16 {
+		top := float64(a)*(1-tx) + float64(b)*tx
+		bottom := float64(c)*(1-tx) + float64(d)*tx
+		return uint16(math.Round(top*(1-ty) + bottom*ty))
+	}
+	p00, p10 := ppm.data[y0][x0], ppm.data[y0][x1]
+	p01, p11 := ppm.data[y1][x0], ppm.data[y1][x1]
+	return Pixel{
+		R: lerp(p00.R, p10.R, p01.R, p11.R),
+		G: lerp(p00.G, p10.G, p01.G, p11.G),
+		B: lerp(p00.B, p10.B, p01.B, p11.B),
+	}
+}
+
+// ResizeBilinear resizes the image to newWidth x newHeight, interpolating
+// each output pixel between the four source pixels around its center.
+// Non-positive dimensions leave the image unchanged.
+func (ppm *PPM) ResizeBilinear(newWidth, newHeight int) {
+	if newWidth <= 0 || newHeight <= 0 || ppm.width <= 0 || ppm.height <= 0 {
+		return
+	}
+	scaleX := float64(ppm.width) / float64(newWidth)
+	scaleY := float64(ppm.height) / float64(newHeight)
+	resized, pix := newPixelGrid(newWidth, newHeight)
+	for y := range resized {
+		fy := (float64(y)+0.5)*scaleY - 0.5
+		for x := range resized[y] {
+			resized[y][x] = ppm.SampleBilinear((float64(x)+0.5)*scaleX-0.5, fy)
+		}
+	}
+	ppm.data, ppm.pix = resized, pix
+	ppm.width, ppm.height = newWidth, newHeight
+}
+
+// CorrectAspect returns a copy of the image resampled to square pixels, where
+// pixelAspect is the width of a source pixel divided by its height. Wide
+// pixels (pixelAspect > 1) stretch the width by pixelAspect and tall ones
+// stretch the height by 1/pixelAspect, so no detail is discarded. Resampling
+// is bilinear. A non-positive or non-finite aspect returns an unchanged copy.
+func (ppm *PPM) CorrectAspect(pixelAspect float64) *PPM {
+	corrected := ppm.Clone()
+	if !(pixelAspect > 0) || math.IsInf(pixelAspect, 0) {
+		return corrected
+	}
+	newWidth, newHeight := ppm.width, ppm.height
+	if pixelAspect > 1 {
+		newWidth = int(math.Round(float64(ppm.width) * pixelAspect))
+	} else {
+		newHeight = int(math.Round(float64(ppm.height) / pixelAspect))
+	}
+	if newWidth != ppm.width || newHeight != ppm.height {
+		corrected.ResizeBilinear(newWidth, newHeight)
+	}
+	return corrected
+}
+
+// BilateralFilter smooths the image while preserving edges. Each neighbor is
+// weighted by its spatial distance (spatialSigma) and by its color distance
+// to the center pixel (rangeSigma). The window extends to 3*spatialSigma.
+func (ppm *PPM) BilateralFilter(spatialSigma, rangeSigma float64) {
+	if spatialSigma <= 0 || rangeSigma <= 0 {
+		return
+	}
+	radius, spatial := bilateralKernel(spatialSigma)
+	pix, stride := ppm.Pix(), ppm.Stride()
+	newData, newPix := newPixelGrid(ppm.width, ppm.height)
+	for y := 0; y < ppm.height; y++ {
+		for x := 0; x < ppm.width; x++ {
+			center := pix[y*stride+x]
+			var sumR, sumG, sumB, weights float64
+			for dy := -radius; dy <= radius; dy++ {
+				ny := y + dy
+				if ny < 0 || ny >= ppm.height {
+					continue
+				}
+				row := pix[ny*stride : ny*stride+ppm.width]
+				for dx := -radius; dx <= radius; dx++ {
+					nx := x + dx
+					if nx < 0 || nx >= ppm.width {
+						continue
+					}
+					pixel := row[nx]
+					dr := float64(pixel.R) - float64(center.R)
+					dg := float64(pixel.G) - float64(center.G)
+					db := float64(pixel.B) - float64(center.B)
+					weight := spatial[dy+radius][dx+radius] * math.Exp(-(dr*dr+dg*dg+db*db)/(2*rangeSigma*rangeSigma))
+					sumR += weight * float64(pixel.R)
+					sumG += weight * float64(pixel.G)
+					sumB += weight * float64(pixel.B)
+					weights += weight
+				}
+			}
+			newPix[y*ppm.width+x] = Pixel{
+				R: uint16(math.Round(sumR / weights)),
+				G: uint16(math.Round(sumG / weights)),
+				B: uint16(math.Round(sumB / weights)),
+			}
+		}
+	}
+	ppm.data, ppm.pix = newData, newPix
+}
+
+// ClearRect fills the rectangle r with a solid color, clipped to the image bounds.
+func (ppm *PPM) ClearRect(r image.Rectangle, color Pixel) {
+	ppm.FillRect(r, color)
+}
+
+// ApplyStencil sets every pixel to color where mask is set, leaving the
+// others untouched. It returns an error if the mask dimensions do not match.
+func (ppm *PPM) ApplyStencil(mask *PBM, color Pixel) error {
+	if mask == nil || mask.width != ppm.width || mask.height != ppm.height {
+		return fmt.Errorf("stencil dimensions do not match image dimensions")
+	}
+	for y := 0; y < ppm.height; y++ {
+		for x := 0; x < ppm.width; x++ {
+			if mask.data[y][x] {
+				ppm.data[y][x] = color
+			}
+		}
+	}
+	return nil
+}
+
+// Watermark tiles mark across the image, starting at the top-left corner with
+// spacing pixels between copies, and blends each copy in with SetPixelBlend at
+// the given opacity in [0, 1]. Mark samples are rescaled to the image's max
+// value. A nil or empty mark leaves the image unchanged; a negative spacing is
+// treated as 0.
+func (ppm *PPM) Watermark(mark *PPM, opacity float64, spacing int) {
+	if mark == nil || mark.width == 0 || mark.height == 0 || mark.max == 0 {
+		return
+	}
+	spacing = max(spacing, 0)
+	scale := float64(ppm.max) / float64(mark.max)
+	rescale := func(v uint16) uint16 {
+		return uint16(math.Round(math.Min(float64(v)*scale, float64(ppm.max))))
+	}
+	for oy := 0; oy < ppm.height; oy += mark.height + spacing {
+		for ox := 0; ox < ppm.width; ox += mark.width + spacing {
+			for y := 0; y < mark.height; y++ {
+				for x := 0; x < mark.width; x++ {
+					pixel := mark.data[y][x]
+					color := Pixel{R: rescale(pixel.R), G: rescale(pixel.G), B: rescale(pixel.B)}
+					ppm.SetPixelBlend(Point{ox + x, oy + y}, color, opacity)
+				}
+			}
+		}
+	}
+}
+
+// Paste copies src onto the image with its top-left corner at (x, y),
+// clipping whatever falls outside the image. Samples are rescaled when the
+// two images have different max values.
+func (ppm *PPM) Paste(src *PPM, x, y int) {
+	ppm.PasteMasked(src, nil, x, y)
+}
+
+// PasteMasked is Paste that only copies the src pixels where mask is set. The
+// mask is aligned with src; pixels outside it count as unset. A nil mask
+// copies every pixel.
+func (ppm *PPM) PasteMasked(src *PPM, mask *PBM, x, y int) {
+	if src == nil {
+		return
+	}
+	for sy := max(0, -y); sy < min(src.height, ppm.height-y); sy++ {
+		for sx := max(0, -x); sx < min(src.width, ppm.width-x); sx++ {
+			if mask != nil && !mask.At(sx, sy) {
+				continue
+			}
+			pixel := src.data[sy][sx]
+			if src.max != ppm.max {
+				pixel = Pixel{
+					R: rescaleSample(pixel.R, src.max, ppm.max),
+					G: rescaleSample(pixel.G, src.max, ppm.max),
+					B: rescaleSample(pixel.B, src.max, ppm.max),
+				}
+			}
+			ppm.data[y+sy][x+sx] = pixel
+		}
+	}
+}
+
+// Crop replaces the image with the sub-rectangle [x, x+w) x [y, y+h). It
+// returns an error, leaving the image unchanged, if the rectangle is empty or
+// extends outside the image.
+func (ppm *PPM) Crop(x, y, w, h int) error {
+	err := checkCrop(x, y, w, h, ppm.width, ppm.height)
+	if err != nil {
+		return err
+	}
+	data, pix := newPixelGrid(w, h)
+	for row := range data {
+		copy(data[row], ppm.data[y+row][x:x+w])
+	}
+	ppm.data, ppm.pix = data, pix
+	ppm.width, ppm.height = w, h
+	return nil
+}
+
+// Clone returns a deep copy of the image that shares no memory with it.
+func (ppm *PPM) Clone() *PPM {
+	clone := &PPM{
+		width:       ppm.width,
+		height:      ppm.height,
+		magicNumber: ppm.magicNumber,
+		max:         ppm.max,
+		comments:    append([]string(nil), ppm.comments...),
+		metadata:    copyMetadata(ppm.metadata),
+	}
+	clone.data, clone.pix = newPixelGrid(ppm.width, ppm.height)
+	for y, row := range ppm.data {
+		copy(clone.data[y], row)
+	}
+	return clone
+}
+
+// Equal reports whether other has the same dimensions, magic number, max value
+// and pixels. Comments are not compared.
+func (ppm *PPM) Equal(other *PPM) bool {
+	if other == nil || ppm.magicNumber != other.magicNumber || ppm.max != other.max {
+		return false
+	}
+	diff, err := ppm.Diff(other)
+	return err == nil && diff == 0
+}
+
+// Diff returns the number of pixels that differ between the image and other.
+// It returns an error if the dimensions do not match.
+func (ppm *PPM) Diff(other *PPM) (int, error) {
+	if other == nil || ppm.width != other.width || ppm.height != other.height {
+		return 0, fmt.Errorf("cannot diff images of different dimensions")
+	}
+	count := 0
+	for y := 0; y < ppm.height; y++ {
+		for x := 0; x < ppm.width; x++ {
+			if ppm.data[y][x] != other.data[y][x] {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// NearestColor returns the palette color closest to color by Euclidean RGB distance.
+// It returns color unchanged when the palette is empty.
+func NearestColor(palette []Pixel, color Pixel) Pixel {
+	if len(palette) == 0 {
+		return color
+	}
+	return palette[nearestIndex(palette, color)]
+}
+
+// nearestIndex returns the index of the palette color closest to color.
+// palette must not be empty.
+func nearestIndex(palette []Pixel, color Pixel) int {
+	best := 0
+	bestDistance := -1
+	for i, candidate := range palette {
+		distance := squaredDistance(candidate, color)
+		if bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+	return best
+}
+
+// squaredDistance returns the squared Euclidean distance between a and b in
+// RGB space.
+func squaredDistance(a, b Pixel) int {
+	dr := int(a.R) - int(b.R)
+	dg := int(a.G) - int(b.G)
+	db := int(a.B) - int(b.B)
+	return dr*dr + dg*dg + db*db
+}
+
+// ReadPalette reads a PPM map file and returns its distinct colors in scan order.
+func ReadPalette(filename string) ([]Pixel, error) {
+	ppm, err := ReadPPM(filename)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[Pixel]bool)
+	var palette []Pixel
+	for _, row := range ppm.data {
+		for _, pixel := range row {
+			if !seen[pixel] {
+				seen[pixel] = true
+				palette = append(palette, pixel)
+			}
+		}
+	}
+	return palette, nil
+}
+
+// MapToPalette replaces every pixel with its nearest palette color.
+func (ppm *PPM) MapToPalette(palette []Pixel) {
+	if len(palette) == 0 {
+		return
+	}
+	cache := make(map[Pixel]Pixel)
+	for y := 0; y < ppm.height; y++ {
+		for x := 0; x < ppm.width; x++ {
+			pixel := ppm.data[y][x]
+			mapped, ok := cache[pixel]
+			if !ok {
+				mapped = NearestColor(palette, pixel)
+				cache[pixel] = mapped
+			}
+			ppm.data[y][x] = mapped
+		}
+	}
+}
+
+// medianCut builds a palette of at most maxColors colors with the median cut
+// algorithm: starting from one box holding every distinct color, the box with
+// the widest channel range is repeatedly split at its median along that
+// channel. Each palette entry is the pixel-count weighted mean of a box, so
+// images with no more than maxColors colors keep them exactly.
+func (ppm *PPM) medianCut(maxColors int) []Pixel {
+	counts := make(map[Pixel]int)
+	for _, row := range ppm.data {
+		for _, pixel := range row {
+			counts[pixel]++
+		}
+	}
+	colors := make([]Pixel, 0, len(counts))
+	for color := range counts {
+		colors = append(colors, color)
+	}
+	if len(colors) == 0 || maxColors <= 0 {
+		return nil
+	}
+
+	channel := func(p Pixel, c int) uint16 { return [3]uint16{p.R, p.G, p.B}[c] }
+	// less orders colors by channel first, then by the remaining channels, so
+	// colors tied on the split channel always land in the same box.
+	less := func(p, q Pixel, first int) bool {
+		for c := 0; c < 3; c++ {
+			k := (first + c) % 3
+			if channel(p, k) != channel(q, k) {
+				return channel(p, k) < channel(q, k)
+			}
+		}
+		return false
+	}
+	// Map iteration order is random; start from a fixed order.
+	sort.Slice(colors, func(a, b int) bool { return less(colors[a], colors[b], 0) })
+	// widest returns the channel with the largest range in box and that range.
+	widest := func(box []Pixel) (int, int) {
+		bestChannel, bestRange := 0, -1
+		for c := 0; c < 3; c++ {
+			low, high := channel(box[0], c), channel(box[0], c)
+			for _, p := range box {
+				low, high = min(low, channel(p, c)), max(high, channel(p, c))
+			}
+			if int(high-low) > bestRange {
+				bestChannel, bestRange = c, int(high-low)
+			}
+		}
+		return bestChannel, bestRange
+	}
+
+	boxes := [][]Pixel{colors}
+	for len(boxes) < maxColors {
+		split, splitChannel, splitRange := -1, 0, 0
+		for i, box := range boxes {
+			c, r := widest(box)
+			if r > splitRange {
+				split, splitChannel, splitRange = i, c, r
+			}
+		}
+		if split < 0 {
+			break
+		}
+		box := boxes[split]
+		sort.Slice(box, func(a, b int) bool {
+			return less(box[a], box[b], splitChannel)
+		})
+		middle := len(box) / 2
+		boxes[split] = box[:middle]
+		boxes = append(boxes, box[middle:])
+	}
+
+	palette := make([]Pixel, len(boxes))
+	for i, box := range boxes {
+		var r, g, b, n float64
+		for _, p := range box {
+			weight := float64(counts[p])
+			r += float64(p.R) * weight
+			g += float64(p.G) * weight
+			b += float64(p.B) * weight
+			n += weight
+		}
+		palette[i] = Pixel{R: uint16(math.Round(r / n)), G: uint16(math.Round(g / n)), B: uint16(math.Round(b / n))}
+	}
+	return palette
+}
+
+// Upscale enlarges the image by an integer factor, replicating each source
+// pixel into a factor x factor block without any interpolation.
+func (ppm *PPM) Upscale(factor int) error {
+	if factor < 1 {
+		return fmt.Errorf("invalid scale factor: %d", factor)
+	}
+	newData, pix := newPixelGrid(ppm.width*factor, ppm.height*factor)
+	for y := range newData {
+		for x := range newData[y] {
+			newData[y][x] = ppm.data[y/factor][x/factor]
+		}
+	}
+	ppm.data, ppm.pix = newData, pix
+	ppm.width *= factor
+	ppm.height *= factor
+	return nil
+}
+
+// Downscale shrinks the image by an integer factor, averaging each
+// factor x factor block into one pixel. When the dimensions are not
+// divisible by factor, the partial blocks on the right and bottom edges
+// are averaged over the pixels they contain.
+func (ppm *PPM) Downscale(factor int) error {
+	if factor < 1 {
+		return fmt.Errorf("invalid scale factor: %d", factor)
+	}
+	newWidth := (ppm.width + factor - 1) / factor
+	newHeight := (ppm.height + factor - 1) / factor
+	newData, pix := newPixelGrid(newWidth, newHeight)
+	for y := 0; y < newHeight; y++ {
+		for x := 0; x < newWidth; x++ {
+			var block []Pixel
+			for sy := y * factor; sy < (y+1)*factor && sy < ppm.height; sy++ {
+				block = append(block, ppm.data[sy][x*factor:min((x+1)*factor, ppm.width)]...)
+			}
+			newData[y][x] = ppm.averageColors(block)
+		}
+	}
+	ppm.data, ppm.pix = newData, pix
+	ppm.width = newWidth
+	ppm.height = newHeight
+	return nil
+}
+
+// Reset discards the image contents and reallocates it as a black image with
+// the given dimensions, max value and magic number, so the struct can be reused.
+func (ppm *PPM) Reset(width, height int, max uint16, magicNumber string) error {
+	if magicNumber != "P3" && magicNumber != "P6" {
+		return fmt.Errorf("invalid magic number: %s", magicNumber)
+	}
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("invalid dimensions: width and height must be positive")
+	}
+	*ppm = *NewPPM(width, height, max)
+	ppm.magicNumber = magicNumber
+	return nil
+}
+
+// ApplyOrientation transforms the image according to an EXIF orientation
+// value (1-8) so that it displays upright. Other values are ignored.
+func (ppm *PPM) ApplyOrientation(orientation int) {
+	if orientation < 2 || orientation > 8 {
+		return
+	}
+	o := exifOrientations[orientation]
+	*ppm = *ppm.Orientation(o.flipH, o.flipV, o.transpose)
+}
+
+// exifOrientations maps EXIF orientation values to the Orientation arguments
+// that undo them.
+var exifOrientations = [9]struct{ flipH, flipV, transpose bool }{
+	2: {flipH: true},
+	3: {flipH: true, flipV: true},
+	4: {flipV: true},
+	5: {transpose: true},
+	6: {flipH: true, transpose: true},
+	7: {flipH: true, flipV: true, transpose: true},
+	8: {flipV: true, transpose: true},
+}
+
+// Orientation returns a new image in any of the 8 dihedral orientations.
+// The source is transposed first (rows become columns) when transpose is set,
+// then mirrored left-right when flipH is set and top-bottom when flipV is set.
+// For example, transpose with flipH is a 90 degree clockwise rotation.
+func (ppm *PPM) Orientation(flipH, flipV, transpose bool) *PPM {
+	width, height := ppm.width, ppm.height
+	if transpose {
+		width, height = height, width
+	}
+	data, pix := newPixelGrid(width, height)
+	out := &PPM{
+		data:        data,
+		pix:         pix,
+		width:       width,
+		height:      height,
+		magicNumber: ppm.magicNumber,
+		max:         ppm.max,
+		comments:    append([]string(nil), ppm.comments...),
+		metadata:    copyMetadata(ppm.metadata),
+	}
+	for y := 0; y < height; y++ {
+		sy := y
+		if flipV {
+			sy = height - 1 - y
+		}
+		for x := 0; x < width; x++ {
+			sx := x
+			if flipH {
+				sx = width - 1 - x
+			}
+			if transpose {
+				out.data[y][x] = ppm.data[sx][sy]
+			} else {
+				out.data[y][x] = ppm.data[sy][sx]
+			}
+		}
+	}
+	return out
+}
+
+// SetLevels applies a per-channel levels adjustment, indexed R, G, B. Samples
+// at or below blackPoint become 0, samples at or above whitePoint become max,
+// and the range in between is stretched and gamma-corrected. Points are in
+// sample units; a gamma of 1 is linear and values <= 0 are treated as 1.
+func (ppm *PPM) SetLevels(blackPoint, whitePoint, gamma [3]float64) {
+	var tables [3][]uint16
+	for c := range tables {
+		tables[c] = levelsTable(ppm.max, blackPoint[c], whitePoint[c], gamma[c])
+	}
+	for y := 0; y < ppm.height; y++ {
+		for x := 0; x < ppm.width; x++ {
+			pixel := &ppm.data[y][x]
+			pixel.R = tables[0][min(pixel.R, ppm.max)]
+			pixel.G = tables[1][min(pixel.G, ppm.max)]
+			pixel.B = tables[2][min(pixel.B, ppm.max)]
+		}
+	}
+}
+
+// levelsTable builds the lookup table mapping every sample in [0, max] through
+// a levels adjustment.
+func levelsTable(max uint16, black, white, gamma float64) []uint16 {
+	if gamma <= 0 {
+		gamma = 1
+	}
+	table := make([]uint16, int(max)+1)
+	for v := range table {
+		value := float64(v)
+		switch {
+		case value <= black:
+			table[v] = 0
+		case value >= white:
+			table[v] = max
+		default:
+			t := math.Pow((value-black)/(white-black), 1/gamma)
+			table[v] = uint16(math.Round(t * float64(max)))
+		}
+	}
+	return table
+}
+
+// CompositeLayers blends an ordered stack of layers back to front with the
+// "over" operator, starting from black. alphas[i] is the opacity mask of
+// layers[i], scaled by its own max value; a nil mask makes the layer opaque.
+// All layers and masks must share the same dimensions. The result uses the
+// max value and magic number of the bottom layer.
+func CompositeLayers(layers []*PPM, alphas []*PGM) (*PPM, error) {
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("no layers to composite")
+	}
+	if len(alphas) != len(layers) {
+		return nil, fmt.Errorf("got %d alpha masks for %d layers", len(alphas), len(layers))
+	}
+	width, height := layers[0].width, layers[0].height
+	for i, layer := range layers {
+		if layer.width != width || layer.height != height {
+			return nil, fmt.Errorf("layer %d is %dx%d, expected %dx%d", i, layer.width, layer.height, width, height)
+		}
+		if alpha := alphas[i]; alpha != nil && (alpha.width != width || alpha.height != height) {
+			return nil, fmt.Errorf("alpha mask %d is %dx%d, expected %dx%d", i, alpha.width, alpha.height, width, height)
+		}
+	}
+
+	out := NewPPM(width, height, layers[0].max)
+	out.magicNumber = layers[0].magicNumber
+	outMax := float64(out.max)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b float64
+			for i, layer := range layers {
+				a := 1.0
+				if alpha := alphas[i]; alpha != nil {
+					a = math.Min(float64(alpha.data[y][x])/float64(alpha.max), 1)
+				}
+				scale := outMax / float64(layer.max)
+				pixel := layer.data[y][x]
+				r = r*(1-a) + float64(pixel.R)*scale*a
+				g = g*(1-a) + float64(pixel.G)*scale*a
+				b = b*(1-a) + float64(pixel.B)*scale*a
+			}
+			out.data[y][x] = Pixel{
+				R: uint16(math.Round(math.Min(r, outMax))),
+				G: uint16(math.Round(math.Min(g, outMax))),
+				B: uint16(math.Round(math.Min(b, outMax))),
+			}
+		}
+	}
+	return out, nil
+}
+
+// AdjustBrightness adds delta to every sample, saturating at 0 and max.
+func (ppm *PPM) AdjustBrightness(delta int) {
+	for y := 0; y < ppm.height; y++ {
+		for x := 0; x < ppm.width; x++ {
+			pixel := &ppm.data[y][x]
+			pixel.R = brighten(pixel.R, delta, ppm.max)
+			pixel.G = brighten(pixel.G, delta, ppm.max)
+			pixel.B = brighten(pixel.B, delta, ppm.max)
+		}
+	}
+}
+
+// AdjustContrast scales every sample's distance from the mid-point (max/2) by
+// factor, saturating at 0 and max. A factor of 1 leaves the image unchanged,
+// below 1 flattens it and above 1 increases contrast.
+func (ppm *PPM) AdjustContrast(factor float64) {
+	for y := 0; y < ppm.height; y++ {
+		for x := 0; x < ppm.width; x++ {
+			pixel := &ppm.data[y][x]
+			pixel.R = contrast(pixel.R, factor, ppm.max)
+			pixel.G = contrast(pixel.G, factor, ppm.max)
+			pixel.B = contrast(pixel.B, factor, ppm.max)
+		}
+	}
+}
+
+// ApplyGamma maps every sample v to max * (v/max)^(1/gamma) through a lookup
+// table. A gamma above 1 brightens mid-tones; values <= 0 are treated as 1.
+func (ppm *PPM) ApplyGamma(gamma float64) {
+	white := float64(ppm.max)
+	ppm.SetLevels([3]float64{}, [3]float64{white, white, white}, [3]float64{gamma, gamma, gamma})
+}
+
+// GaussianBlur smooths the image with a Gaussian kernel of 2*radius+1 taps
+// and standard deviation sigma, applied to each channel as two separable 1D
+// passes. Borders are clamped so edge pixels are not darkened. A non-positive
+// radius or sigma leaves the image unchanged.
+func (ppm *PPM) GaussianBlur(radius int, sigma float64) {
+	if radius <= 0 || sigma <= 0 {
+		return
+	}
+	kernel := gaussianKernel(radius, sigma)
+	channels := ppm.channelData()
+	for c := range channels {
+		channels[c] = convolveSeparable(channels[c], kernel)
+	}
+	ppm.setChannelData(channels)
+}
+
+// channelData returns a copy of the R, G and B planes as float64.
+func (ppm *PPM) channelData() [3][][]float64 {
+	var channels [3][][]float64
+	for c := range channels {
+		channels[c] = make([][]float64, ppm.height)
+	}
+	pix, stride := ppm.Pix(), ppm.Stride()
+	for y := 0; y < ppm.height; y++ {
+		for c := range channels {
+			channels[c][y] = make([]float64, ppm.width)
+		}
+		row := pix[y*stride : y*stride+ppm.width]
+		for x, pixel := range row {
+			channels[0][y][x] = float64(pixel.R)
+			channels[1][y][x] = float64(pixel.G)
+			channels[2][y][x] = float64(pixel.B)
+		}
+	}
+	return channels
+}
+
+// setChannelData rounds the R, G and B planes back into the image, clamping
+// to [0, max].
+func (ppm *PPM) setChannelData(channels [3][][]float64) {
+	limit := float64(ppm.max)
+	sample := func(v float64) uint16 {
+		return uint16(math.Max(0, math.Min(math.Round(v), limit)))
+	}
+	pix, stride := ppm.Pix(), ppm.Stride()
+	for y := 0; y < ppm.height; y++ {
+		row := pix[y*stride : y*stride+ppm.width]
+		for x := range row {
+			row[x] = Pixel{
+				R: sample(channels[0][y][x]),
+				G: sample(channels[1][y][x]),
+				B: sample(channels[2][y][x]),
+			}
+		}
+	}
+}
+
+// BoxBlur replaces every sample with the mean of the (2*radius+1)^2 square
+// around it, computed per channel as two separable passes with clamped
+// borders. A non-positive radius leaves the image unchanged.
+func (ppm *PPM) BoxBlur(radius int) {
+	if radius <= 0 {
+		return
+	}
+	kernel := boxKernel(radius)
+	channels := ppm.channelData()
+	for c := range channels {
+		channels[c] = convolveSeparable(channels[c], kernel)
+	}
+	ppm.setChannelData(channels)
+}
+
+// Sharpen applies an unsharp mask: each sample moves away from a Gaussian
+// blurred copy (radius 2, sigma 1) by amount times their difference, so
+// amount 0 is a no-op and larger amounts give stronger edges. Results are
+// clamped to [0, max].
+func (ppm *PPM) Sharpen(amount float64) {
+	kernel := gaussianKernel(2, 1)
+	channels := ppm.channelData()
+	for c := range channels {
+		blurred := convolveSeparable(channels[c], kernel)
+		for y := range channels[c] {
+			for x := range channels[c][y] {
+				channels[c][y][x] += amount * (channels[c][y][x] - blurred[y][x])
+			}
+		}
+	}
+	ppm.setChannelData(channels)
+}
+
+// SobelEdges returns the Sobel gradient magnitude of the image's Rec. 601
+// luminance as a grayscale image; see PGM.SobelEdges.
+func (ppm *PPM) SobelEdges() *PGM {
+	gray, _ := ppm.ToPGMWeighted("rec601")
+	return gray.SobelEdges()
+}
+
+// MedianFilter replaces each sample with the median of its channel over the
+// (2*radius+1)^2 neighborhood, clamped at the borders. It removes
+// salt-and-pepper noise while keeping edges sharp.
+func (ppm *PPM) MedianFilter(radius int) {
+	if radius <= 0 {
+		return
+	}
+	size := (2*radius + 1) * (2*radius + 1)
+	r, g, b := make([]uint16, size), make([]uint16, size), make([]uint16, size)
+	pix, stride := ppm.Pix(), ppm.Stride()
+	newData, newPix := newPixelGrid(ppm.width, ppm.height)
+	for y := 0; y < ppm.height; y++ {
+		for x := 0; x < ppm.width; x++ {
+			i := 0
+			for dy := -radius; dy <= radius; dy++ {
+				sy := clamp(y+dy, 0, ppm.height-1)
+				row := pix[sy*stride : sy*stride+ppm.width]
+				for dx := -radius; dx <= radius; dx++ {
+					pixel := row[clamp(x+dx, 0, ppm.width-1)]
+					r[i], g[i], b[i] = pixel.R, pixel.G, pixel.B
+					i++
+				}
+			}
+			newPix[y*ppm.width+x] = Pixel{R: median(r), G: median(g), B: median(b)}
+		}
+	}
+	ppm.data, ppm.pix = newData, newPix
+}
+
+// Convolve applies a user-supplied kernel to each channel: every sample
+// becomes the kernel-weighted sum of its neighborhood, divided by divisor,
+// plus offset. It follows the same rules as PGM.Convolve.
+func (ppm *PPM) Convolve(kernel [][]float64, divisor float64, offset float64) {
+	if !validKernel(kernel) {
+		return
+	}
+	if divisor == 0 {
+		divisor = 1
+	}
+	channels := ppm.channelData()
+	for c := range channels {
+		channels[c] = convolve(channels[c], kernel, divisor, offset)
+	}
+	ppm.setChannelData(channels)
+}
+
+// TileOptions controls how TilesWithOptions handles the edge tiles when the
+// image size is not a multiple of the tile size.
+type TileOptions struct {
+	// Pad extends the edge tiles to the full tile size, filling the area
+	// outside the image with Background. By default edge tiles are clipped
+	// to the image.
+	Pad        bool
+	Background Pixel
+}
+
+// Tiles splits the image into a grid of tileW x tileH tiles, indexed as
+// tiles[row][column]. Edge tiles are clipped to the image.
+func (ppm *PPM) Tiles(tileW, tileH int) [][]*PPM {
+	return ppm.TilesWithOptions(tileW, tileH, TileOptions{})
+}
+
+// TilesWithOptions is Tiles with control over the edge tiles. It returns nil
+// if the tile size is not positive. Each tile is an independent copy with the
+// image's magic number and max value.
+func (ppm *PPM) TilesWithOptions(tileW, tileH int, opts TileOptions) [][]*PPM {
+	if tileW <= 0 || tileH <= 0 {
+		return nil
+	}
+	rows := (ppm.height + tileH - 1) / tileH
+	cols := (ppm.width + tileW - 1) / tileW
+	tiles := make([][]*PPM, rows)
+	for ty := range tiles {
+		tiles[ty] = make([]*PPM, cols)
+		for tx := range tiles[ty] {
+			x0, y0 := tx*tileW, ty*tileH
+			w, h := min(tileW, ppm.width-x0), min(tileH, ppm.height-y0)
+			if opts.Pad {
+				w, h = tileW, tileH
+			}
+			tile := NewPPM(w, h, ppm.max)
+			tile.magicNumber = ppm.magicNumber
+			for y := 0; y < h; y++ {
+				n := 0
+				if y0+y < ppm.height {
+					n = copy(tile.data[y], ppm.data[y0+y][x0:min(x0+w, ppm.width)])
+				}
+				for x := n; x < w; x++ {
+					tile.data[y][x] = opts.Background
+				}
+			}
+			tiles[ty][tx] = tile
+		}
+	}
+	return tiles
+}
+
+// AssembleTiles stitches a grid of tiles, indexed as tiles[row][column], back
+// into one image; it is the inverse of Tiles. Every row must have the same
+// number of tiles, tiles in a row must share a height, tiles in a column must
+// share a width, and all tiles must share a max value. The result takes the
+// magic number of the top-left tile.
+func AssembleTiles(tiles [][]*PPM) (*PPM, error) {
+	if len(tiles) == 0 || len(tiles[0]) == 0 {
+		return nil, fmt.Errorf("no tiles to assemble")
+	}
+	first := tiles[0][0]
+	width, height := 0, 0
+	for ty, row := range tiles {
+		if len(row) != len(tiles[0]) {
+			return nil, fmt.Errorf("tile row %d has %d tiles, expected %d", ty, len(row), len(tiles[0]))
+		}
+		for tx, tile := range row {
+			if tile == nil {
+				return nil, fmt.Errorf("tile (%d,%d) is nil", tx, ty)
+			}
+			if tile.max != first.max {
+				return nil, fmt.Errorf("tile (%d,%d) has max value %d, expected %d", tx, ty, tile.max, first.max)
+			}
+			if tile.height != row[0].height {
+				return nil, fmt.Errorf("tile (%d,%d) is %d pixels high, expected %d", tx, ty, tile.height, row[0].height)
+			}
+			if tile.width != tiles[0][tx].width {
+				return nil, fmt.Errorf("tile (%d,%d) is %d pixels wide, expected %d", tx, ty, tile.width, tiles[0][tx].width)
+			}
+		}
+		height += row[0].height
+	}
+	for _, tile := range tiles[0] {
+		width += tile.width
+	}
+
+	ppm := NewPPM(width, height, first.max)
+	ppm.magicNumber = first.magicNumber
+	y0 := 0
+	for _, row := range tiles {
+		x0 := 0
+		for _, tile := range row {
+			for y := 0; y < tile.height; y++ {
+				copy(ppm.data[y0+y][x0:], tile.data[y])
+			}
+			x0 += tile.width
+		}
+		y0 += row[0].height
+	}
+	return ppm, nil
+}
+
+// Histogram returns the number of pixels at each level of the red, green and
+// blue channels. As with PGM.Histogram, each slice always has length max+1
+// and entry v counts the samples equal to v.
+func (ppm *PPM) Histogram() (r, g, b []int) {
+	r = make([]int, int(ppm.max)+1)
+	g = make([]int, int(ppm.max)+1)
+	b = make([]int, int(ppm.max)+1)
+	for _, row := range ppm.data {
+		for _, pixel := range row {
+			r[min(pixel.R, ppm.max)]++
+			g[min(pixel.G, ppm.max)]++
+			b[min(pixel.B, ppm.max)]++
+		}
+	}
+	return r, g, b
+}
+
+// Translate shifts the image by dx pixels right and dy pixels down. With mode
+// "wrap" pixels pushed off one edge reappear on the opposite one; with mode
+// "fill" they are dropped and the uncovered pixels take fill. It returns an
+// error, leaving the image unchanged, for any other mode.
+func (ppm *PPM) Translate(dx, dy int, mode string, fill Pixel) error {
+	source, err := translation(dx, dy, ppm.width, ppm.height, mode)
+	if err != nil {
+		return err
+	}
+	data, pix := newPixelGrid(ppm.width, ppm.height)
+	for y := range data {
+		for x := range data[y] {
+			sx, sy, ok := source(x, y)
+			if !ok {
+				data[y][x] = fill
+				continue
+			}
+			data[y][x] = ppm.data[sy][sx]
+		}
+	}
+	ppm.data, ppm.pix = data, pix
+	return nil
+}
+
+// MarkerStyle selects the shape drawn by DrawMarker.
+type MarkerStyle int
+
+const (
+	// MarkerCross draws an X through the point.
+	MarkerCross MarkerStyle = iota
+	// MarkerPlus draws a + through the point.
+	MarkerPlus
+	// MarkerSquare draws the outline of a square centered on the point.
+	MarkerSquare
+	// MarkerCircle draws the outline of a circle centered on the point.
+	MarkerCircle
+)
+
+// DrawMarker draws a marker of the given style centered on p, for annotating
+// points such as detected corners or template matches. size is the distance
+// from p to the marker's edge, so the marker spans 2*size+1 pixels. Pixels
+// outside the image are clipped.
+func (ppm *PPM) DrawMarker(p Point, size int, color Pixel, style MarkerStyle) {
+	if size < 0 {
+		return
+	}
+	switch style {
+	case MarkerCross:
+		ppm.DrawLine(Point{p.X - size, p.Y - size}, Point{p.X + size, p.Y + size}, color)
+		ppm.DrawLine(Point{p.X - size, p.Y + size}, Point{p.X + size, p.Y - size}, color)
+	case MarkerPlus:
+		ppm.DrawLine(Point{p.X - size, p.Y}, Point{p.X + size, p.Y}, color)
+		ppm.DrawLine(Point{p.X, p.Y - size}, Point{p.X, p.Y + size}, color)
+	case MarkerSquare:
+		ppm.DrawRectangle(Point{p.X - size, p.Y - size}, 2*size, 2*size, color)
+	case MarkerCircle:
+		ppm.DrawCircle(p, size, color)
+	}
+}
+
+// ColorSplash turns the image gray except for the pixels whose Euclidean RGB
+// distance from keep is at most tolerance, which keep their color. Gray
+// pixels take the Rec. 601 luminance of their color.
+func (ppm *PPM) ColorSplash(keep Pixel, tolerance float64) {
+	for y := 0; y < ppm.height; y++ {
+		for x := 0; x < ppm.width; x++ {
+			pixel := ppm.data[y][x]
+			if math.Sqrt(float64(squaredDistance(pixel, keep))) <= tolerance {
+				continue
+			}
+			gray := rgbToGray(pixel)
+			ppm.data[y][x] = Pixel{R: gray, G: gray, B: gray}
+		}
+	}
+}
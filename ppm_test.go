@@ -0,0 +1,1161 @@
+package Netpbm
+
+import (
+	"image"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var white = Pixel{255, 255, 255}
+
+func TestFractalDepthIsClamped(t *testing.T) {
+	done := make(chan [2]*PPM)
+	go func() {
+		huge, capped := NewPPM(300, 300, 255), NewPPM(300, 300, 255)
+		huge.DrawKochSnowflake(30, Point{20, 80}, 240, white)
+		huge.DrawSierpinskiTriangle(30, Point{20, 20}, 240, white)
+		capped.DrawKochSnowflake(MaxFractalDepth, Point{20, 80}, 240, white)
+		capped.DrawSierpinskiTriangle(MaxFractalDepth, Point{20, 20}, 240, white)
+		done <- [2]*PPM{huge, capped}
+	}()
+	select {
+	case images := <-done:
+		if !images[0].Equal(images[1]) {
+			t.Error("depth 30 should draw the same image as MaxFractalDepth")
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("drawing a depth-30 fractal did not finish")
+	}
+}
+
+func TestFractalSmallDepthUnaffected(t *testing.T) {
+	draw := func() *PPM {
+		ppm := NewPPM(100, 100, 255)
+		ppm.DrawKochSnowflake(2, Point{10, 30}, 80, white)
+		ppm.DrawSierpinskiTriangle(2, Point{10, 10}, 80, white)
+		return ppm
+	}
+	capped := draw()
+	defer func(depth int) { MaxFractalDepth = depth }(MaxFractalDepth)
+	MaxFractalDepth = 20
+	if !capped.Equal(draw()) {
+		t.Error("a depth below the cap should not be affected by it")
+	}
+}
+
+// mask returns a PBM with a pixel set wherever ppm has the given color.
+func mask(ppm *PPM, color Pixel) *PBM {
+	pbm := NewPBM(ppm.width, ppm.height)
+	for y := range ppm.data {
+		for x := range ppm.data[y] {
+			pbm.data[y][x] = ppm.data[y][x] == color
+		}
+	}
+	return pbm
+}
+
+func TestKochSnowflakeSegmentsMeet(t *testing.T) {
+	ppm := NewPPM(300, 300, 255)
+	ppm.DrawKochSnowflake(3, Point{25, 80}, 243, white)
+	// Consecutive segments that met more than a pixel apart would split the
+	// outline into several 8-connected components.
+	_, sizes := mask(ppm, white).labelComponents()
+	if len(sizes) != 2 {
+		t.Fatalf("snowflake outline has %d components, want 1", len(sizes)-1)
+	}
+
+	curve := NewPPM(100, 40, 255)
+	curve.KochSnowflake(3, Point{5, 30}, Point{86, 30}, white)
+	if curve.At(5, 30) != white || curve.At(86, 30) != white {
+		t.Error("Koch curve should start and end exactly on its endpoints")
+	}
+	_, sizes = mask(curve, white).labelComponents()
+	if len(sizes) != 2 {
+		t.Errorf("Koch curve has %d components, want 1", len(sizes)-1)
+	}
+}
+
+func TestPPMSampleBilinear(t *testing.T) {
+	ppm := NewPPM(2, 2, 255)
+	ppm.data[0] = []Pixel{{0, 0, 0}, {100, 0, 40}}
+	ppm.data[1] = []Pixel{{0, 200, 40}, {100, 200, 80}}
+	if got, want := ppm.SampleBilinear(0.5, 0.5), (Pixel{50, 100, 40}); got != want {
+		t.Errorf("SampleBilinear(0.5, 0.5) = %v, want %v", got, want)
+	}
+	if got := ppm.SampleBilinear(1, 0); got != ppm.data[0][1] {
+		t.Errorf("sampling a pixel center = %v, want %v", got, ppm.data[0][1])
+	}
+	if got := ppm.SampleBilinear(-5, 9); got != ppm.data[1][0] {
+		t.Errorf("sampling outside the image = %v, want the clamped corner %v", got, ppm.data[1][0])
+	}
+}
+
+func TestPPMBilateralFilterKeepsEdges(t *testing.T) {
+	ppm := NewPPM(12, 6, 255)
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 12; x++ {
+			if x < 6 {
+				ppm.data[y][x] = Pixel{uint16(40 + (x+y)%3*4), 40, 40}
+			} else {
+				ppm.data[y][x] = Pixel{220, 220, 220}
+			}
+		}
+	}
+	ppm.BilateralFilter(2, 20)
+	for y := 0; y < 6; y++ {
+		if left, right := ppm.data[y][5], ppm.data[y][6]; left.R > 60 || right.R < 200 {
+			t.Errorf("row %d: edge blurred to %v|%v", y, left, right)
+		}
+		for x := 0; x < 5; x++ {
+			if r := ppm.data[y][x].R; r < 40 || r > 48 {
+				t.Errorf("pixel (%d,%d) red = %d, want within the original noise range", x, y, r)
+			}
+		}
+	}
+}
+
+// filledPPM returns a width x height image filled with color.
+func filledPPM(width, height int, color Pixel) *PPM {
+	ppm := NewPPM(width, height, 255)
+	for _, row := range ppm.data {
+		for x := range row {
+			row[x] = color
+		}
+	}
+	return ppm
+}
+
+func TestClearRect(t *testing.T) {
+	red := Pixel{R: 255}
+	ppm := filledPPM(6, 6, white)
+	ppm.ClearRect(image.Rect(2, 2, 4, 4), red)
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 6; x++ {
+			want := white
+			if (image.Point{x, y}).In(image.Rect(2, 2, 4, 4)) {
+				want = red
+			}
+			if got := ppm.At(x, y); got != want {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	// Rectangles reaching outside the image are clipped.
+	ppm.ClearRect(image.Rect(-3, 4, 2, 10), red)
+	if ppm.At(0, 5) != red || ppm.At(1, 4) != red || ppm.At(2, 5) != white {
+		t.Error("clipped ClearRect filled the wrong pixels")
+	}
+
+	pgm := NewPGM(4, 4, 255)
+	pgm.ClearRect(image.Rect(1, 1, 3, 3), 9)
+	if pgm.data[1][1] != 9 || pgm.data[2][2] != 9 || pgm.data[0][0] != 0 || pgm.data[3][3] != 0 {
+		t.Errorf("PGM ClearRect = %v", pgm.data)
+	}
+	pbm := NewPBM(4, 4)
+	pbm.ClearRect(image.Rect(3, 3, 9, 9), true)
+	if !pbm.data[3][3] || pbm.data[2][2] {
+		t.Errorf("PBM ClearRect = %v", pbm.data)
+	}
+}
+
+func TestMapToPalette(t *testing.T) {
+	palette := []Pixel{{0, 0, 0}, {255, 0, 0}, {0, 255, 0}, {255, 255, 255}}
+	filename := filepath.Join(t.TempDir(), "palette.ppm")
+	paletteImage := NewPPM(len(palette), 1, 255)
+	copy(paletteImage.data[0], palette)
+	if err := paletteImage.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ReadPalette(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ppm := NewPPM(64, 4, 255)
+	for y := range ppm.data {
+		for x := range ppm.data[y] {
+			ppm.data[y][x] = Pixel{uint16(x * 4), uint16(y * 60), uint16(255 - x*4)}
+		}
+	}
+	ppm.MapToPalette(loaded)
+	members := make(map[Pixel]bool)
+	for _, color := range palette {
+		members[color] = true
+	}
+	for y := range ppm.data {
+		for x, pixel := range ppm.data[y] {
+			if !members[pixel] {
+				t.Fatalf("pixel (%d,%d) = %v is not a palette color", x, y, pixel)
+			}
+		}
+	}
+	if got := NearestColor(palette, Pixel{200, 30, 10}); got != palette[1] {
+		t.Errorf("NearestColor = %v, want red", got)
+	}
+}
+
+func TestPPMUpscaleReplicatesPixels(t *testing.T) {
+	source := []Pixel{{255, 0, 0}, {0, 255, 0}, {0, 0, 255}, white}
+	ppm := NewPPM(2, 2, 255)
+	for i, color := range source {
+		ppm.data[i/2][i%2] = color
+	}
+	if err := ppm.Upscale(3); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := ppm.Size(); w != 6 || h != 6 {
+		t.Fatalf("size = %dx%d, want 6x6", w, h)
+	}
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 6; x++ {
+			if want := source[(y/3)*2+x/3]; ppm.At(x, y) != want {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, ppm.At(x, y), want)
+			}
+		}
+	}
+	if err := ppm.Upscale(0); err == nil {
+		t.Error("Upscale(0) succeeded, want an error")
+	}
+}
+
+func TestPPMDownscaleAveragesBlocks(t *testing.T) {
+	ppm := NewPPM(4, 4, 255)
+	for y := range ppm.data {
+		for x := range ppm.data[y] {
+			ppm.data[y][x] = Pixel{uint16(x * 10), uint16(y * 20), uint16((x + y) * 4)}
+		}
+	}
+	if err := ppm.Downscale(2); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]Pixel{
+		{{5, 10, 4}, {25, 10, 12}},
+		{{5, 50, 12}, {25, 50, 20}},
+	}
+	if w, h := ppm.Size(); w != 2 || h != 2 {
+		t.Fatalf("size = %dx%d, want 2x2", w, h)
+	}
+	for y := range want {
+		for x := range want[y] {
+			if ppm.At(x, y) != want[y][x] {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, ppm.At(x, y), want[y][x])
+			}
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	ppm := filledPPM(2, 2, white)
+	if err := ppm.Reset(3, 3, 100, "P6"); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := ppm.Size(); w != 3 || h != 3 || ppm.max != 100 || ppm.magicNumber != "P6" {
+		t.Fatalf("after Reset: %dx%d max %d magic %s, want 3x3 max 100 P6", w, h, ppm.max, ppm.magicNumber)
+	}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			if ppm.At(x, y) != (Pixel{}) {
+				t.Errorf("pixel (%d,%d) = %v, want black", x, y, ppm.At(x, y))
+			}
+		}
+	}
+	if err := ppm.Reset(2, 2, 255, "P5"); err == nil {
+		t.Error("Reset with magic number P5 succeeded, want an error")
+	}
+}
+
+// insidePolygon is the classic even-odd ray-casting test.
+func insidePolygon(polygon []Point, px, py float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		xi, yi := float64(polygon[i].X), float64(polygon[i].Y)
+		xj, yj := float64(polygon[j].X), float64(polygon[j].Y)
+		if (yi > py) != (yj > py) && px < (xj-xi)*(py-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func TestFillScanlinesMatchesPointInPolygon(t *testing.T) {
+	const width, height = 24, 20
+	triangle := []Point{{1, 1}, {18, 4}, {6, 15}}
+	filled := make(map[image.Point]bool)
+	FillScanlines(width, height, triangle, func(x, y int) {
+		if filled[image.Pt(x, y)] {
+			t.Errorf("pixel (%d,%d) set twice", x, y)
+		}
+		filled[image.Pt(x, y)] = true
+	})
+	if len(filled) == 0 {
+		t.Fatal("no pixels filled")
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if want := insidePolygon(triangle, float64(x)+0.5, float64(y)+0.5); filled[image.Pt(x, y)] != want {
+				t.Errorf("pixel (%d,%d) filled = %v, want %v", x, y, !want, want)
+			}
+		}
+	}
+}
+
+// countColor returns the number of pixels equal to color, and fails the test
+// if any pixel outside [x0, x1) x [y0, y1) has it.
+func countColor(t *testing.T, ppm *PPM, color Pixel, x0, y0, x1, y1 int) int {
+	t.Helper()
+	count := 0
+	for y := range ppm.data {
+		for x, pixel := range ppm.data[y] {
+			if pixel != color {
+				continue
+			}
+			count++
+			if x < x0 || x >= x1 || y < y0 || y >= y1 {
+				t.Errorf("pixel (%d,%d) painted outside [%d,%d)x[%d,%d)", x, y, x0, x1, y0, y1)
+			}
+		}
+	}
+	return count
+}
+
+func TestDrawFilledRectangle(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		p              Point
+		width, height  int
+		x0, y0, x1, y1 int
+	}{
+		{"inside", Point{2, 3}, 3, 2, 2, 3, 5, 5},
+		{"off left", Point{-2, 1}, 4, 2, 0, 1, 2, 3},
+		{"off top", Point{1, -3}, 2, 5, 1, 0, 3, 2},
+		{"off right", Point{8, 4}, 5, 3, 8, 4, 10, 7},
+		{"off bottom", Point{0, 6}, 3, 9, 0, 6, 3, 8},
+		{"fully outside", Point{-5, -5}, 3, 3, 0, 0, 0, 0},
+	} {
+		ppm := NewPPM(10, 8, 255)
+		ppm.DrawFilledRectangle(tc.p, tc.width, tc.height, white)
+		want := (tc.x1 - tc.x0) * (tc.y1 - tc.y0)
+		if got := countColor(t, ppm, white, tc.x0, tc.y0, tc.x1, tc.y1); got != want {
+			t.Errorf("%s: %d pixels filled, want %d", tc.name, got, want)
+		}
+	}
+}
+
+func TestDrawCircleRadiusAndGaps(t *testing.T) {
+	const radius = 20
+	center := Point{25, 25}
+	ppm := NewPPM(51, 51, 255)
+	ppm.DrawCircle(center, radius, white)
+	for _, p := range []Point{{45, 25}, {5, 25}, {25, 5}, {25, 45}} {
+		if ppm.At(p.X, p.Y) != white {
+			t.Errorf("circle does not pass through %v", p)
+		}
+	}
+	for y := center.Y - radius; y <= center.Y+radius; y++ {
+		found := false
+		for x := 0; x < 51; x++ {
+			if ppm.At(x, y) == white {
+				found = true
+				if d := math.Hypot(float64(x-center.X), float64(y-center.Y)); math.Abs(d-radius) > 1 {
+					t.Errorf("pixel (%d,%d) is %.2f from the center, want about %d", x, y, d, radius)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("row %d has no outline pixel", y)
+		}
+	}
+	if _, sizes := mask(ppm, white).labelComponents(); len(sizes) != 2 {
+		t.Errorf("outline has %d connected pieces, want 1", len(sizes)-1)
+	}
+}
+
+func TestFillRect(t *testing.T) {
+	ppm := NewPPM(5, 4, 255)
+	ppm.FillRect(image.Rect(0, 0, 2, 2), white)
+	if got := countColor(t, ppm, white, 0, 0, 2, 2); got != 4 {
+		t.Errorf("Rect(0,0,2,2) filled %d pixels, want 4", got)
+	}
+
+	ppm = NewPPM(5, 4, 255)
+	ppm.FillRect(image.Rect(3, -2, 9, 2), white)
+	if got := countColor(t, ppm, white, 3, 0, 5, 2); got != 4 {
+		t.Errorf("clipped rectangle filled %d pixels, want 4", got)
+	}
+}
+
+func TestSetLevelsPerChannel(t *testing.T) {
+	ppm := NewPPM(3, 1, 255)
+	ppm.Set(0, 0, Pixel{40, 40, 40})
+	ppm.Set(1, 0, Pixel{60, 200, 10})
+	ppm.Set(2, 0, Pixel{255, 128, 255})
+	ppm.SetLevels([3]float64{64, 0, 0}, [3]float64{255, 255, 255}, [3]float64{1, 1, 1})
+	want := []Pixel{{0, 40, 40}, {0, 200, 10}, {255, 128, 255}}
+	for x, w := range want {
+		if got := ppm.At(x, 0); got != w {
+			t.Errorf("pixel %d = %v, want %v", x, got, w)
+		}
+	}
+}
+
+func TestOrientationAllDistinct(t *testing.T) {
+	// A 3x2 image with every pixel different, so no symmetry hides a mistake.
+	ppm := NewPPM(3, 2, 255)
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			ppm.Set(x, y, Pixel{uint16(y*3 + x), 0, 0})
+		}
+	}
+	var results []*PPM
+	for i := 0; i < 8; i++ {
+		results = append(results, ppm.Orientation(i&1 != 0, i&2 != 0, i&4 != 0))
+	}
+	for i := range results {
+		for j := i + 1; j < len(results); j++ {
+			if results[i].Equal(results[j]) {
+				t.Errorf("orientations %03b and %03b produced the same image", i, j)
+			}
+		}
+	}
+	if !results[0].Equal(ppm) {
+		t.Error("Orientation(false, false, false) changed the image")
+	}
+
+	clockwise := ppm.Clone()
+	clockwise.Rotate90CW()
+	if !results[5].Equal(clockwise) {
+		t.Error("transpose with flipH is not a clockwise rotation")
+	}
+}
+
+func TestCompositeLayers(t *testing.T) {
+	red, blue := Pixel{255, 0, 0}, Pixel{0, 0, 255}
+	bottom := filledPPM(4, 1, red)
+	top := filledPPM(4, 1, blue)
+	// Top layer: opaque, half, clear, clear.
+	alpha := newPGMFrom(100, []uint16{100, 50, 0, 0})
+	out, err := CompositeLayers([]*PPM{bottom, top}, []*PGM{nil, alpha})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Pixel{blue, {128, 0, 128}, red, red}
+	for x, w := range want {
+		if got := out.At(x, 0); got != w {
+			t.Errorf("pixel %d = %v, want %v", x, got, w)
+		}
+	}
+
+	if _, err := CompositeLayers([]*PPM{bottom, filledPPM(3, 1, blue)}, []*PGM{nil, nil}); err == nil {
+		t.Error("layers of different sizes composited without an error")
+	}
+	if _, err := CompositeLayers([]*PPM{bottom}, nil); err == nil {
+		t.Error("missing alpha slice composited without an error")
+	}
+}
+
+func TestToPGMWeightedGreen(t *testing.T) {
+	ppm := filledPPM(1, 1, Pixel{0, 255, 0})
+	for mode, want := range map[string]uint16{"average": 85, "rec601": 150, "rec709": 182} {
+		pgm, err := ppm.ToPGMWeighted(mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pgm.At(0, 0); got != want {
+			t.Errorf("%s: green = %d, want %d", mode, got, want)
+		}
+	}
+	if _, err := ppm.ToPGMWeighted("rec2020"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestBoxBlurFlatIsNoOp(t *testing.T) {
+	color := Pixel{17, 200, 99}
+	ppm := filledPPM(7, 5, color)
+	ppm.BoxBlur(2)
+	if !ppm.Equal(filledPPM(7, 5, color)) {
+		t.Error("box blur changed a flat image")
+	}
+}
+
+func TestSharpenIncreasesEdgeContrast(t *testing.T) {
+	ppm := NewPPM(10, 3, 255)
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 10; x++ {
+			if x < 5 {
+				ppm.Set(x, y, Pixel{80, 80, 80})
+			} else {
+				ppm.Set(x, y, Pixel{160, 160, 160})
+			}
+		}
+	}
+	ppm.Sharpen(1)
+	dark, bright := ppm.At(4, 1), ppm.At(5, 1)
+	if dark.R >= 80 || bright.R <= 160 {
+		t.Errorf("edge = %v | %v, want darker than 80 and brighter than 160", dark, bright)
+	}
+	if far := ppm.At(0, 1); far != (Pixel{80, 80, 80}) {
+		t.Errorf("pixel far from the edge = %v, want unchanged", far)
+	}
+}
+
+func TestNewPPMRowsIndependent(t *testing.T) {
+	ppm := NewPPM(3, 3, 255)
+	ppm.data[0] = append(ppm.data[0], white)
+	ppm.data[0][0] = white
+	ppm.Set(2, 1, Pixel{1, 2, 3})
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			want := Pixel{}
+			switch {
+			case x == 0 && y == 0:
+				want = white
+			case x == 2 && y == 1:
+				want = Pixel{1, 2, 3}
+			}
+			if got := ppm.data[y][x]; got != want {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestNewPPMWithCapacity(t *testing.T) {
+	ppm := NewPPMWithCapacity(4, 3)
+	if !ppm.Equal(NewPPM(4, 3, 255)) {
+		t.Errorf("NewPPMWithCapacity(4, 3) differs from NewPPM(4, 3, 255)")
+	}
+	if !ppm.contiguous() {
+		t.Error("NewPPMWithCapacity rows are not contiguous")
+	}
+}
+
+func TestGeometryKeepsContiguousLayout(t *testing.T) {
+	for name, op := range map[string]func(*PPM){
+		"Crop":           func(p *PPM) { p.Crop(1, 1, 3, 2) },
+		"Rotate90CW":     func(p *PPM) { p.Rotate90CW() },
+		"Rotate90CCW":    func(p *PPM) { p.Rotate90CCW() },
+		"ResizeBilinear": func(p *PPM) { p.ResizeBilinear(7, 2) },
+		"Upscale":        func(p *PPM) { p.Upscale(2) },
+		"Downscale":      func(p *PPM) { p.Downscale(2) },
+		"Orientation":    func(p *PPM) { *p = *p.Orientation(true, false, true) },
+	} {
+		ppm := numbered(5, 4)
+		op(ppm)
+		if !ppm.contiguous() {
+			t.Errorf("%s left the rows outside the image's pixel block", name)
+		}
+	}
+}
+
+// perRowPixelGrid allocates each row separately, the layout NewPPM used to
+// have, as a baseline for BenchmarkNewPPM.
+func perRowPixelGrid(width, height int) [][]Pixel {
+	grid := make([][]Pixel, height)
+	for y := range grid {
+		grid[y] = make([]Pixel, width)
+	}
+	return grid
+}
+
+func BenchmarkNewPPM(b *testing.B) {
+	b.Run("contiguous", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			NewPPM(1024, 768, 255)
+		}
+	})
+	b.Run("per-row", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			perRowPixelGrid(1024, 768)
+		}
+	})
+}
+
+func TestDrawFilledPolygonConcaveArrow(t *testing.T) {
+	arrow := []Point{{2, 6}, {10, 6}, {10, 2}, {18, 10}, {10, 18}, {10, 14}, {2, 14}}
+	ppm := NewPPM(21, 21, 255)
+	// Pre-existing pixels of the fill color, one outside the arrow and one
+	// inside, must not change which pixels get filled.
+	ppm.Set(5, 3, white)
+	ppm.Set(6, 10, white)
+	ppm.DrawFilledPolygon(arrow, white)
+
+	for _, p := range []Point{{3, 7}, {5, 10}, {9, 13}, {11, 4}, {15, 10}, {11, 16}, {2, 14}, {18, 10}} {
+		if ppm.At(p.X, p.Y) != white {
+			t.Errorf("pixel %v inside the arrow is not filled", p)
+		}
+	}
+	for _, p := range []Point{{5, 4}, {7, 3}, {8, 5}, {5, 16}, {14, 4}, {15, 16}, {19, 10}, {1, 10}} {
+		if ppm.At(p.X, p.Y) == white {
+			t.Errorf("pixel %v outside the arrow is filled", p)
+		}
+	}
+	if ppm.At(5, 3) != white {
+		t.Error("pre-existing pixel outside the arrow was cleared")
+	}
+}
+
+func TestDrawLineAAShallowDiagonal(t *testing.T) {
+	ppm := NewPPM(22, 8, 255)
+	ppm.DrawLineAA(Point{1, 1}, Point{20, 6}, white)
+	full, partial := 0, 0
+	for x := 1; x <= 20; x++ {
+		column := 0
+		for y := 0; y < 8; y++ {
+			v := ppm.At(x, y).R
+			column += int(v)
+			switch {
+			case v == 255:
+				full++
+			case v > 0:
+				partial++
+			}
+			if p := ppm.At(x, y); p.R != p.G || p.G != p.B {
+				t.Fatalf("pixel (%d,%d) = %v is not a blend of black and white", x, y, p)
+			}
+		}
+		// Each column's coverage sums to one pixel, give or take rounding.
+		if column < 253 || column > 257 {
+			t.Errorf("column %d coverage = %d, want about 255", x, column)
+		}
+	}
+	if full == 0 || partial == 0 {
+		t.Errorf("%d full and %d fractional pixels, want both", full, partial)
+	}
+}
+
+func TestPixStrideMatchesAt(t *testing.T) {
+	ppm := NewPPM(5, 3, 255)
+	// Give the image separately allocated rows, as some operations leave it.
+	rows := perRowPixelGrid(5, 3)
+	for y := range rows {
+		for x := range rows[y] {
+			rows[y][x] = Pixel{uint16(x), uint16(y), uint16(x * y)}
+		}
+	}
+	ppm.data = rows
+
+	pix, stride := ppm.Pix(), ppm.Stride()
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 5; x++ {
+			if pix[y*stride+x] != ppm.At(x, y) {
+				t.Errorf("Pix()[%d] = %v, At(%d, %d) = %v", y*stride+x, pix[y*stride+x], x, y, ppm.At(x, y))
+			}
+		}
+	}
+	pix[2*stride+4] = white
+	if ppm.At(4, 2) != white {
+		t.Error("write through Pix is not visible to At")
+	}
+	ppm.Set(1, 1, Pixel{7, 7, 7})
+	if pix[stride+1] != (Pixel{7, 7, 7}) {
+		t.Error("Set is not visible through Pix")
+	}
+}
+
+// perRowGaussianBlur is GaussianBlur reading and writing the image through
+// its rows rather than the contiguous Pix slice, as a baseline for
+// BenchmarkPPMGaussianBlur.
+func perRowGaussianBlur(ppm *PPM, radius int, sigma float64) {
+	kernel := gaussianKernel(radius, sigma)
+	var channels [3][][]float64
+	for c := range channels {
+		channels[c] = make([][]float64, ppm.height)
+		for y := range channels[c] {
+			channels[c][y] = make([]float64, ppm.width)
+		}
+	}
+	for y, row := range ppm.data {
+		for x, pixel := range row {
+			channels[0][y][x] = float64(pixel.R)
+			channels[1][y][x] = float64(pixel.G)
+			channels[2][y][x] = float64(pixel.B)
+		}
+	}
+	for c := range channels {
+		channels[c] = convolveSeparable(channels[c], kernel)
+	}
+	limit := float64(ppm.max)
+	sample := func(v float64) uint16 {
+		return uint16(math.Max(0, math.Min(math.Round(v), limit)))
+	}
+	for y, row := range ppm.data {
+		for x := range row {
+			row[x] = Pixel{R: sample(channels[0][y][x]), G: sample(channels[1][y][x]), B: sample(channels[2][y][x])}
+		}
+	}
+}
+
+func TestPerRowGaussianBlurMatchesGaussianBlur(t *testing.T) {
+	ppm := numbered(9, 7)
+	baseline := ppm.Clone()
+	ppm.GaussianBlur(2, 1.2)
+	perRowGaussianBlur(baseline, 2, 1.2)
+	if !ppm.Equal(baseline) {
+		t.Errorf("per-row baseline = %v, want %v", baseline.data, ppm.data)
+	}
+}
+
+func BenchmarkPPMGaussianBlur(b *testing.B) {
+	fill := func(data [][]Pixel) {
+		for y := range data {
+			for x := range data[y] {
+				data[y][x] = Pixel{uint16(x % 256), uint16(y % 256), uint16((x ^ y) % 256)}
+			}
+		}
+	}
+	b.Run("contiguous", func(b *testing.B) {
+		ppm := NewPPM(1024, 1024, 255)
+		fill(ppm.data)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			ppm.GaussianBlur(3, 1.5)
+		}
+	})
+	b.Run("per-row", func(b *testing.B) {
+		ppm := &PPM{data: perRowPixelGrid(1024, 1024), width: 1024, height: 1024, magicNumber: "P3", max: 255}
+		fill(ppm.data)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			perRowGaussianBlur(ppm, 3, 1.5)
+		}
+	})
+}
+
+func TestApplyStencilCross(t *testing.T) {
+	base := Pixel{10, 20, 30}
+	ppm := filledPPM(3, 3, base)
+	stencil := newPBMFrom(
+		"010",
+		"111",
+		"010",
+	)
+	red := Pixel{255, 0, 0}
+	if err := ppm.ApplyStencil(stencil, red); err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			want := base
+			if stencil.At(x, y) {
+				want = red
+			}
+			if got := ppm.At(x, y); got != want {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+	if err := ppm.ApplyStencil(NewPBM(2, 3), red); err == nil {
+		t.Error("stencil of the wrong size was applied")
+	}
+}
+
+func TestDrawThickLineCrossSection(t *testing.T) {
+	for _, thickness := range []int{2, 3, 5} {
+		// Horizontal: count the column through the midpoint.
+		ppm := NewPPM(40, 40, 255)
+		ppm.DrawThickLine(Point{5, 20}, Point{35, 20}, thickness, white)
+		if got := countColor(t, ppm, white, 0, 0, 40, 40) / 31; got != thickness {
+			t.Errorf("horizontal thickness %d: %d rows drawn", thickness, got)
+		}
+		column := 0
+		for y := 0; y < 40; y++ {
+			if ppm.At(20, y) == white {
+				column++
+			}
+		}
+		if column != thickness {
+			t.Errorf("horizontal thickness %d: midpoint cross-section is %d pixels", thickness, column)
+		}
+
+		// Vertical: count the row through the midpoint.
+		ppm = NewPPM(40, 40, 255)
+		ppm.DrawThickLine(Point{20, 5}, Point{20, 35}, thickness, white)
+		row := 0
+		for x := 0; x < 40; x++ {
+			if ppm.At(x, 20) == white {
+				row++
+			}
+		}
+		if row != thickness {
+			t.Errorf("vertical thickness %d: midpoint cross-section is %d pixels", thickness, row)
+		}
+
+		// Diagonal: walk the perpendicular through the midpoint in half-pixel
+		// steps and measure how far the line extends.
+		ppm = NewPPM(40, 40, 255)
+		ppm.DrawThickLine(Point{5, 5}, Point{35, 35}, thickness, white)
+		extent := 0.0
+		for s := -10.0; s <= 10; s += 0.5 {
+			x, y := 20+s/math.Sqrt2, 20-s/math.Sqrt2
+			if ppm.At(int(math.Round(x)), int(math.Round(y))) == white {
+				extent = math.Max(extent, math.Abs(s))
+			}
+		}
+		if math.Abs(2*extent-float64(thickness)) > 1.5 {
+			t.Errorf("diagonal thickness %d: midpoint cross-section is about %.1f pixels", thickness, 2*extent)
+		}
+	}
+
+	ppm := NewPPM(10, 10, 255)
+	ppm.DrawThickLine(Point{1, 1}, Point{8, 8}, 0, white)
+	ppm.DrawThickLine(Point{1, 8}, Point{8, 1}, -3, white)
+	if got := countColor(t, ppm, white, 0, 0, 0, 0); got != 0 {
+		t.Errorf("non-positive thickness drew %d pixels", got)
+	}
+}
+
+func TestDrawEllipse(t *testing.T) {
+	center, rx, ry := Point{20, 12}, 15, 7
+	ppm := NewPPM(41, 25, 255)
+	ppm.DrawEllipse(center, rx, ry, white)
+	for _, p := range []Point{{center.X + rx, center.Y}, {center.X - rx, center.Y}, {center.X, center.Y + ry}, {center.X, center.Y - ry}} {
+		if ppm.At(p.X, p.Y) != white {
+			t.Errorf("ellipse does not touch %v", p)
+		}
+	}
+	if countColor(t, ppm, white, center.X-rx, center.Y-ry, center.X+rx+1, center.Y+ry+1) == 0 {
+		t.Fatal("nothing drawn")
+	}
+	if ppm.At(center.X, center.Y) == white {
+		t.Error("outline filled the center")
+	}
+
+	filled := NewPPM(41, 25, 255)
+	filled.DrawFilledEllipse(center, rx, ry, white)
+	for y := center.Y - ry; y <= center.Y+ry; y++ {
+		first, last := -1, -1
+		for x := 0; x < 41; x++ {
+			if filled.At(x, y) == white {
+				if first < 0 {
+					first = x
+				}
+				last = x
+			}
+		}
+		for x := first; x <= last; x++ {
+			if filled.At(x, y) != white {
+				t.Errorf("gap in filled ellipse at (%d,%d)", x, y)
+			}
+		}
+		// The fill covers the outline.
+		for x := 0; x < 41; x++ {
+			if ppm.At(x, y) == white && (x < first || x > last) {
+				t.Errorf("outline pixel (%d,%d) lies outside the fill", x, y)
+			}
+		}
+	}
+
+	// Plotting is clipped to the image.
+	clipped := NewPPM(10, 10, 255)
+	clipped.DrawEllipse(Point{0, 0}, 20, 5, white)
+	clipped.DrawFilledEllipse(Point{9, 9}, 5, 20, white)
+}
+
+func TestWatermarkTiles(t *testing.T) {
+	ppm := NewPPM(10, 10, 255)
+	ppm.Watermark(filledPPM(2, 2, white), 0.5, 2)
+	half := Pixel{128, 128, 128}
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			// Tiles start every 4 pixels: 2 of mark, 2 of spacing.
+			want := Pixel{}
+			if x%4 < 2 && y%4 < 2 {
+				want = half
+			}
+			if got := ppm.At(x, y); got != want {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestBezierStraightAndEndpoints(t *testing.T) {
+	// Collinear control points draw a straight segment.
+	quadratic := NewPPM(40, 20, 255)
+	quadratic.DrawQuadraticBezier(Point{2, 3}, Point{12, 7}, Point{37, 17}, white)
+	cubic := NewPPM(40, 20, 255)
+	cubic.DrawCubicBezier(Point{2, 3}, Point{17, 9}, Point{27, 13}, Point{37, 17}, white)
+
+	for name, ppm := range map[string]*PPM{"quadratic": quadratic, "cubic": cubic} {
+		if ppm.At(2, 3) != white || ppm.At(37, 17) != white {
+			t.Errorf("%s curve misses an endpoint", name)
+		}
+		for y := 0; y < 20; y++ {
+			for x := 0; x < 40; x++ {
+				if ppm.At(x, y) != white {
+					continue
+				}
+				// Every pixel lies within a pixel of the straight segment.
+				d := math.Abs(float64(14*(x-2)-35*(y-3))) / math.Hypot(14, 35)
+				if d > 1 {
+					t.Errorf("%s pixel (%d,%d) is %.2f from the line", name, x, y, d)
+				}
+			}
+		}
+	}
+
+	curve := NewPPM(40, 40, 255)
+	curve.DrawCubicBezier(Point{1, 38}, Point{5, 0}, Point{35, 0}, Point{38, 38}, white)
+	if curve.At(1, 38) != white || curve.At(38, 38) != white {
+		t.Error("cubic curve misses an endpoint")
+	}
+	if _, sizes := mask(curve, white).labelComponents(); len(sizes) != 2 {
+		t.Errorf("curve has %d pieces, want 1", len(sizes)-1)
+	}
+}
+
+func TestCorrectAspectDoublesWidth(t *testing.T) {
+	ppm := NewPPM(6, 6, 255)
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 6; x++ {
+			ppm.Set(x, y, Pixel{uint16(x * 40), uint16(y * 40), 0})
+		}
+	}
+	corrected := ppm.CorrectAspect(2)
+	if w, h := corrected.Size(); w != 12 || h != 6 {
+		t.Fatalf("size = %dx%d, want 12x6", w, h)
+	}
+	if w, h := ppm.Size(); w != 6 || h != 6 {
+		t.Errorf("source changed to %dx%d", w, h)
+	}
+	// Rows keep their values; columns are stretched.
+	if got := corrected.At(0, 3); got.G != 120 || got.R != 0 {
+		t.Errorf("pixel (0,3) = %v, want R 0, G 120", got)
+	}
+	if got := corrected.At(11, 5); got != (Pixel{200, 200, 0}) {
+		t.Errorf("pixel (11,5) = %v, want {200 200 0}", got)
+	}
+
+	tall := ppm.CorrectAspect(0.5)
+	if w, h := tall.Size(); w != 6 || h != 12 {
+		t.Errorf("pixelAspect 0.5 size = %dx%d, want 6x12", w, h)
+	}
+}
+
+// numbered returns a width x height image whose pixel (x, y) has R = x and
+// G = y, so any misplaced pixel is visible.
+func numbered(width, height int) *PPM {
+	ppm := NewPPM(width, height, 255)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			ppm.data[y][x] = Pixel{uint16(x), uint16(y), 7}
+		}
+	}
+	return ppm
+}
+
+func TestTiles(t *testing.T) {
+	tiles := numbered(4, 4).Tiles(2, 2)
+	if len(tiles) != 2 || len(tiles[0]) != 2 || len(tiles[1]) != 2 {
+		t.Fatalf("got %d tile rows, want 2 rows of 2", len(tiles))
+	}
+	for ty := 0; ty < 2; ty++ {
+		for tx := 0; tx < 2; tx++ {
+			tile := tiles[ty][tx]
+			if w, h := tile.Size(); w != 2 || h != 2 {
+				t.Fatalf("tile (%d,%d) is %dx%d, want 2x2", tx, ty, w, h)
+			}
+			for y := 0; y < 2; y++ {
+				for x := 0; x < 2; x++ {
+					if got, want := tile.At(x, y), (Pixel{uint16(tx*2 + x), uint16(ty*2 + y), 7}); got != want {
+						t.Errorf("tile (%d,%d) pixel (%d,%d) = %v, want %v", tx, ty, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+
+	clipped := numbered(5, 3).Tiles(2, 2)
+	if w, h := clipped[1][2].Size(); w != 1 || h != 1 {
+		t.Errorf("clipped corner tile is %dx%d, want 1x1", w, h)
+	}
+	padded := numbered(5, 3).TilesWithOptions(2, 2, TileOptions{Pad: true, Background: white})
+	corner := padded[1][2]
+	if w, h := corner.Size(); w != 2 || h != 2 {
+		t.Errorf("padded corner tile is %dx%d, want 2x2", w, h)
+	}
+	if corner.At(0, 0) != (Pixel{4, 2, 7}) || corner.At(1, 1) != white {
+		t.Errorf("padded corner tile = %v", corner.data)
+	}
+}
+
+func TestAssembleTilesRoundTrip(t *testing.T) {
+	source := numbered(7, 5)
+	for _, size := range [][2]int{{2, 2}, {3, 5}, {7, 1}, {4, 3}} {
+		assembled, err := AssembleTiles(source.Tiles(size[0], size[1]))
+		if err != nil {
+			t.Fatalf("%dx%d tiles: %v", size[0], size[1], err)
+		}
+		if !assembled.Equal(source) {
+			t.Errorf("%dx%d tiles did not reassemble to the original", size[0], size[1])
+		}
+	}
+
+	tiles := source.Tiles(2, 2)
+	tiles[0][1] = numbered(3, 2)
+	if _, err := AssembleTiles(tiles); err == nil {
+		t.Error("tiles with mismatched column widths assembled without an error")
+	}
+	if _, err := AssembleTiles(nil); err == nil {
+		t.Error("an empty grid assembled without an error")
+	}
+}
+
+func TestAtOK(t *testing.T) {
+	ppm := NewPPM(3, 2, 255)
+	ppm.Set(2, 1, white)
+	if p, ok := ppm.AtOK(2, 1); !ok || p != white {
+		t.Errorf("AtOK(2, 1) = %v, %v, want %v, true", p, ok, white)
+	}
+	if p, ok := ppm.AtOK(0, 0); !ok || p != (Pixel{}) {
+		t.Errorf("AtOK(0, 0) = %v, %v, want black, true", p, ok)
+	}
+	for _, c := range []Point{{-1, 0}, {3, 0}, {0, 2}, {0, -1}} {
+		if p, ok := ppm.AtOK(c.X, c.Y); ok || p != (Pixel{}) {
+			t.Errorf("AtOK(%d, %d) = %v, %v, want zero pixel, false", c.X, c.Y, p, ok)
+		}
+	}
+}
+
+func TestPPMToPBMThreshold(t *testing.T) {
+	// Luminances 0, 76, 127 (rgbToGray truncates), 255.
+	ppm := NewPPM(4, 1, 255)
+	ppm.Set(1, 0, Pixel{255, 0, 0})
+	ppm.Set(2, 0, Pixel{128, 128, 128})
+	ppm.Set(3, 0, white)
+	for _, tc := range []struct {
+		threshold uint8
+		want      string
+	}{
+		{0, "1111"},
+		{100, "0011"},
+		{255, "0001"},
+	} {
+		got := ppm.ToPBMThreshold(tc.threshold)
+		if diff, err := got.Diff(newPBMFrom(tc.want)); err != nil || diff != 0 {
+			t.Errorf("ToPBMThreshold(%d) = %v, want %s", tc.threshold, got.data, tc.want)
+		}
+	}
+}
+
+func TestPPMToPBMMatchesThreshold128(t *testing.T) {
+	for _, max := range []uint16{255, 1000} {
+		ppm := NewPPM(64, 2, max)
+		for x := 0; x < 64; x++ {
+			v := uint16(x * int(max) / 63)
+			ppm.Set(x, 0, Pixel{v, v, v})
+			ppm.Set(x, 1, Pixel{v, max - v, v / 2})
+		}
+		got, want := ppm.ToPBM(), ppm.ToPBMThreshold(128)
+		if !got.Equal(want) {
+			t.Errorf("max %d: ToPBM() = %v, want ToPBMThreshold(128) = %v", max, got.data, want.data)
+		}
+	}
+}
+
+func TestPPMHistogram(t *testing.T) {
+	ppm := NewPPM(3, 1, 4)
+	ppm.Set(0, 0, Pixel{4, 0, 1})
+	ppm.Set(1, 0, Pixel{4, 2, 1})
+	ppm.Set(2, 0, Pixel{0, 2, 1})
+	r, g, b := ppm.Histogram()
+	if len(r) != 5 || len(g) != 5 || len(b) != 5 {
+		t.Fatalf("channel lengths %d, %d, %d, want 5", len(r), len(g), len(b))
+	}
+	if !reflect.DeepEqual(r, []int{1, 0, 0, 0, 2}) || !reflect.DeepEqual(g, []int{1, 0, 2, 0, 0}) || !reflect.DeepEqual(b, []int{0, 3, 0, 0, 0}) {
+		t.Errorf("Histogram() = %v, %v, %v", r, g, b)
+	}
+}
+
+func TestDrawMarkerPlus(t *testing.T) {
+	ppm := NewPPM(11, 11, 255)
+	ppm.DrawMarker(Point{5, 5}, 3, white, MarkerPlus)
+	for y := 0; y < 11; y++ {
+		for x := 0; x < 11; x++ {
+			onArm := (y == 5 && x >= 2 && x <= 8) || (x == 5 && y >= 2 && y <= 8)
+			if got := ppm.At(x, y) == white; got != onArm {
+				t.Errorf("pixel (%d,%d) set = %v, want %v", x, y, got, onArm)
+			}
+		}
+	}
+
+	// Markers at the border are clipped rather than panicking.
+	clipped := NewPPM(5, 5, 255)
+	for _, style := range []MarkerStyle{MarkerCross, MarkerPlus, MarkerSquare, MarkerCircle} {
+		clipped.DrawMarker(Point{0, 4}, 3, white, style)
+	}
+}
+
+func TestPasteOverhangingCorner(t *testing.T) {
+	ppm := NewPPM(4, 4, 255)
+	ppm.Paste(numbered(3, 3), 2, -1)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			want := Pixel{}
+			if x >= 2 && y <= 1 {
+				want = Pixel{uint16(x - 2), uint16(y + 1), 7}
+			}
+			if got := ppm.At(x, y); got != want {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestPasteMasked(t *testing.T) {
+	ppm := NewPPM(4, 3, 255)
+	src := filledPPM(3, 2, white)
+	mask := newPBMFrom(
+		"101",
+		"010",
+	)
+	ppm.PasteMasked(src, mask, 1, 1)
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 4; x++ {
+			want := Pixel{}
+			if mask.At(x-1, y-1) {
+				want = white
+			}
+			if got := ppm.At(x, y); got != want {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	// Samples are rescaled between max values.
+	deep := NewPPM(1, 1, 1000)
+	deep.Paste(filledPPM(1, 1, Pixel{255, 0, 51}), 0, 0)
+	if got := deep.At(0, 0); got != (Pixel{1000, 0, 200}) {
+		t.Errorf("rescaled paste = %v, want {1000 0 200}", got)
+	}
+}
+
+func TestColorSplash(t *testing.T) {
+	red := Pixel{220, 20, 30}
+	nearRed := Pixel{210, 25, 35}
+	blue := Pixel{10, 40, 200}
+	green := Pixel{30, 180, 60}
+	ppm := NewPPM(4, 1, 255)
+	ppm.data[0] = []Pixel{red, nearRed, blue, green}
+
+	ppm.ColorSplash(Pixel{220, 20, 20}, 30)
+
+	for x, want := range []Pixel{red, nearRed} {
+		if got := ppm.At(x, 0); got != want {
+			t.Errorf("pixel %d = %v, want %v kept", x, got, want)
+		}
+	}
+	for x, orig := range map[int]Pixel{2: blue, 3: green} {
+		gray := rgbToGray(orig)
+		if got, want := ppm.At(x, 0), (Pixel{gray, gray, gray}); got != want {
+			t.Errorf("pixel %d = %v, want gray %v", x, got, want)
+		}
+	}
+}